@@ -1,7 +1,6 @@
 package pocs
 
 import (
-	"bytes"
 	"context"
 	"heaven/app/APVE/pkg/common/requests"
 	poc "heaven/app/APVE/pkg/protocols"
@@ -52,7 +51,7 @@ func (st *Struts_2061) PocExec(vulUrl string) map[string]interface{} {
 	response, err := res.Text()
 	if err != nil {
 	}
-	if bytes.Contains([]byte(response),[]byte("uid=")) {
+	if res.Contains("uid=") {
 		st.data = response
 		st.status = true
 		result["vulId"] = st.vulId
@@ -1,7 +1,6 @@
 package pocs
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"heaven/app/APVE/pkg/common/requests"
@@ -36,7 +35,7 @@ func (tp *Thinkphp) PocExec(vulUrl string) map[string]interface{} {
 	response, err := res.Text()
 	if err != nil {
 	}
-	if bytes.Contains([]byte(response), []byte("uid=")) {
+	if res.Contains("uid=") {
 		tp.data = response
 		tp.status = true
 		result["vulId"] = tp.vulId
@@ -0,0 +1,534 @@
+package requests
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//认证在中间件的最内层执行，覆盖其他中间件设置的Authorization
+//多个认证选项只有最后一个生效
+
+//Basic认证
+func WithBasicAuth(username, password string) DialOption {
+	return func(opts *dialOptions) {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		opts.auth = authHeaderMiddleware(auth)
+	}
+}
+
+//Bearer Token认证
+func WithBearer(token string) DialOption {
+	return func(opts *dialOptions) {
+		opts.auth = authHeaderMiddleware("Bearer " + token)
+	}
+}
+
+func authHeaderMiddleware(auth string) Middleware {
+	return func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			request.Header.Set("Authorization", auth)
+			return next(client, request)
+		}
+	}
+}
+
+//RFC 7616 Digest认证
+//收到401的challenge后自动带上认证重新请求，之后的请求复用challenge
+//在New中设置时同一个client的请求共用challenge
+func WithDigestAuth(username, password string) DialOption {
+	d := &digestAuth{username: username, password: password, cnonce: newCnonce}
+	return func(opts *dialOptions) {
+		opts.auth = d.middleware()
+	}
+}
+
+type digestAuth struct {
+	username string
+	password string
+	cnonce   func() string
+
+	mu        sync.Mutex
+	challenge *digestChallenge
+	nc        uint32
+}
+
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	userhash  bool
+}
+
+func (d *digestAuth) middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			d.mu.Lock()
+			cached := d.challenge
+			d.mu.Unlock()
+			if cached != nil {
+				if err := d.authorize(request, cached); err != nil {
+					return nil, err
+				}
+			}
+
+			resp, err := next(client, request)
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				return resp, err
+			}
+			challenge := parseDigestChallenge(resp.Header.Values("WWW-Authenticate"))
+			//用缓存的challenge认证失败，只有nonce过期时才重试
+			if challenge == nil || cached != nil && cached.nonce == challenge.nonce {
+				return resp, err
+			}
+			if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+				return resp, err
+			}
+
+			d.mu.Lock()
+			d.challenge = challenge
+			d.nc = 0
+			d.mu.Unlock()
+
+			req := request.Clone(request.Context())
+			if request.GetBody != nil {
+				if req.Body, err = request.GetBody(); err != nil {
+					return resp, err
+				}
+			}
+			if err := d.authorize(req, challenge); err != nil {
+				return resp, err
+			}
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+			_ = resp.Body.Close()
+			return next(client, req)
+		}
+	}
+}
+
+//计算Authorization并设置到request中
+func (d *digestAuth) authorize(request *http.Request, c *digestChallenge) error {
+	d.mu.Lock()
+	d.nc++
+	nc := fmt.Sprintf("%08x", d.nc)
+	d.mu.Unlock()
+
+	var body []byte
+	if c.qop == "auth-int" && request.GetBody != nil {
+		r, err := request.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	request.Header.Set("Authorization", d.header(c, request.Method, request.URL.RequestURI(), nc, d.cnonce(), body))
+	return nil
+}
+
+func (d *digestAuth) header(c *digestChallenge, method, uri, nc, cnonce string, body []byte) string {
+	h := digestHash(c.algorithm)
+	ha1 := h(d.username + ":" + c.realm + ":" + d.password)
+	if strings.HasSuffix(c.algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	a2 := method + ":" + uri
+	if c.qop == "auth-int" {
+		a2 += ":" + h(string(body))
+	}
+	ha2 := h(a2)
+
+	var response string
+	if c.qop == "" {
+		//RFC 2069
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+	}
+
+	var b strings.Builder
+	b.WriteString("Digest ")
+	switch {
+	case c.userhash:
+		fmt.Fprintf(&b, "username=%s, userhash=true", quote(h(d.username+":"+c.realm)))
+	case !isASCII(d.username):
+		fmt.Fprintf(&b, "username*=UTF-8''%s", url.PathEscape(d.username))
+	default:
+		fmt.Fprintf(&b, "username=%s", quote(d.username))
+	}
+	fmt.Fprintf(&b, ", realm=%s, uri=%s, algorithm=%s, nonce=%s", quote(c.realm), quote(uri), c.algorithm, quote(c.nonce))
+	if c.qop != "" {
+		fmt.Fprintf(&b, ", nc=%s, cnonce=%s, qop=%s", nc, quote(cnonce), c.qop)
+	}
+	fmt.Fprintf(&b, ", response=%s", quote(response))
+	if c.opaque != "" {
+		fmt.Fprintf(&b, ", opaque=%s", quote(c.opaque))
+	}
+	return b.String()
+}
+
+//支持的算法，越靠前越优先
+var digestAlgorithms = []string{"SHA-512-256", "SHA-256", "MD5"}
+
+func digestHash(algorithm string) func(string) string {
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "SHA-512-256":
+		newHash = sha512.New512_256
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		newHash = md5.New
+	}
+	return func(s string) string {
+		h := newHash()
+		_, _ = io.WriteString(h, s)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+//从WWW-Authenticate中选择算法最强的Digest challenge，没有可用的时返回nil
+func parseDigestChallenge(values []string) *digestChallenge {
+	var best *digestChallenge
+	rank := len(digestAlgorithms)
+	for _, value := range values {
+		for _, c := range parseChallenges(value) {
+			if !strings.EqualFold(c.scheme, "Digest") || c.params["nonce"] == "" {
+				continue
+			}
+			algorithm := strings.ToUpper(c.params["algorithm"])
+			if algorithm == "" {
+				algorithm = "MD5"
+			}
+			r := -1
+			for i, a := range digestAlgorithms {
+				if algorithm == a || algorithm == a+"-SESS" {
+					r = i
+				}
+			}
+			if r < 0 || r >= rank {
+				continue
+			}
+			qop := ""
+			for _, q := range strings.Split(c.params["qop"], ",") {
+				switch strings.TrimSpace(strings.ToLower(q)) {
+				case "auth":
+					qop = "auth"
+				case "auth-int":
+					if qop == "" {
+						qop = "auth-int"
+					}
+				}
+			}
+			if c.params["qop"] != "" && qop == "" {
+				continue
+			}
+			rank = r
+			best = &digestChallenge{
+				realm:     c.params["realm"],
+				nonce:     c.params["nonce"],
+				opaque:    c.params["opaque"],
+				algorithm: algorithm,
+				qop:       qop,
+				userhash:  strings.EqualFold(c.params["userhash"], "true"),
+			}
+		}
+	}
+	return best
+}
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+//解析一个WWW-Authenticate的值，其中可能有多个challenge
+//eg: Digest realm="a", qop="auth,auth-int", nonce="n", Basic realm="b"
+func parseChallenges(value string) []challenge {
+	var challenges []challenge
+	s := value
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return challenges
+		}
+		token, rest := cutToken(s)
+		if token == "" {
+			return challenges
+		}
+		rest = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(rest, "=") && len(challenges) > 0 {
+			//上一个challenge的参数
+			var v string
+			v, s = cutValue(strings.TrimLeft(rest[1:], " \t"))
+			challenges[len(challenges)-1].params[strings.ToLower(token)] = v
+			continue
+		}
+		challenges = append(challenges, challenge{scheme: token, params: map[string]string{}})
+		s = rest
+	}
+}
+
+func cutToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+//读取token或者带引号的值
+func cutValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, " \t,")
+		if i < 0 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func newCnonce() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+//AWS的访问凭证，SessionToken只有临时凭证才有
+type AWSCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+//AWS Signature Version 4签名
+//body不能重新读取时使用UNSIGNED-PAYLOAD
+func WithAWSSigV4(credentials AWSCredentials, region, service string) DialOption {
+	signer := &awsSigner{credentials: credentials, region: region, service: service, now: time.Now}
+	return func(opts *dialOptions) {
+		opts.auth = signer.middleware()
+	}
+}
+
+type awsSigner struct {
+	credentials AWSCredentials
+	region      string
+	service     string
+	now         func() time.Time
+}
+
+const (
+	awsAlgorithm      = "AWS4-HMAC-SHA256"
+	awsTimeFormat     = "20060102T150405Z"
+	awsUnsignedBody   = "UNSIGNED-PAYLOAD"
+	awsEmptyBodyHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	awsContentSHA256  = "X-Amz-Content-Sha256"
+	awsSecurityHeader = "X-Amz-Security-Token"
+)
+
+func (s *awsSigner) middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			payload, err := payloadHash(request)
+			if err != nil {
+				return nil, err
+			}
+			s.sign(request, payload, s.now())
+			return next(client, request)
+		}
+	}
+}
+
+func payloadHash(request *http.Request) (string, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return awsEmptyBodyHash, nil
+	}
+	if request.GetBody == nil {
+		return awsUnsignedBody, nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *awsSigner) sign(request *http.Request, payload string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format(awsTimeFormat)
+	scope := strings.Join([]string{t.Format("20060102"), s.region, s.service, "aws4_request"}, "/")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	if s.credentials.SessionToken != "" {
+		request.Header.Set(awsSecurityHeader, s.credentials.SessionToken)
+	}
+	//S3要求这个header
+	if s.service == "s3" {
+		request.Header.Set(awsContentSHA256, payload)
+	}
+
+	canonicalHeaders, signedHeaders := awsCanonicalHeaders(request)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		awsCanonicalPath(request.URL, s.service != "s3"),
+		awsCanonicalQuery(request.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payload,
+	}, "\n")
+	stringToSign := strings.Join([]string{awsAlgorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.credentials.SecretKey), t.Format("20060102"))
+	for _, part := range []string{s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsAlgorithm, s.credentials.AccessKey, scope, signedHeaders, signature))
+}
+
+//签名host、content-type、content-md5和所有x-amz-*
+func awsCanonicalHeaders(request *http.Request) (string, string) {
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+//除S3外路径的每一段都要编码两次
+func awsCanonicalPath(u *url.URL, twice bool) string {
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segment = awsEscape(segment)
+		if twice {
+			segment = awsEscape(segment)
+		}
+		segments[i] = segment
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(u *url.URL) string {
+	var pairs [][2]string
+	for key, values := range u.Query() {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{awsEscape(key), awsEscape(value)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+//按RFC 3986编码，只保留unreserved字符
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,114 @@
+package requests
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/axgle/mahonia"
+)
+
+//在body开头查找meta中的charset
+const charsetPrescan = 4 << 10
+
+var metaCharsetRe = regexp.MustCompile(`(?is)<meta\b[^>]*?charset\s*=\s*["']?\s*([\w.:-]+)`)
+
+//页面中使用的编码名称对应的mahonia编码，按WHATWG Encoding Standard和IANA名称不同的地方处理
+//mahonia没有gb2312等常用的别名，Big5不能按GBK解码
+var charsetAliases = map[string]string{
+	"gb2312":       "GBK",
+	"gbk":          "GBK",
+	"cp936":        "GBK",
+	"x-gbk":        "GBK",
+	"windows-936":  "GBK",
+	"gb18030":      "GB18030",
+	"big5":         "Big5",
+	"big5-hkscs":   "Big5",
+	"x-big5":       "Big5",
+	"cn-big5":      "Big5",
+	"shift_jis":    "Shift_JIS",
+	"shift-jis":    "Shift_JIS",
+	"sjis":         "Shift_JIS",
+	"x-sjis":       "Shift_JIS",
+	"windows-31j":  "Shift_JIS",
+	"ms_kanji":     "Shift_JIS",
+	"euc-jp":       "EUC-JP",
+	"x-euc-jp":     "EUC-JP",
+	"iso-8859-1":   "windows-1252",
+	"latin1":       "windows-1252",
+	"us-ascii":     "windows-1252",
+	"ascii":        "windows-1252",
+	"utf8":         "UTF-8",
+	"utf-8":        "UTF-8",
+	"unicode-1-1":  "UTF-8",
+	"utf-16":       "UTF-16LE",
+	"utf-16le":     "UTF-16LE",
+	"utf-16be":     "UTF-16BE",
+	"iso8859-1":    "windows-1252",
+	"windows-1252": "windows-1252",
+}
+
+//CharsetName 编码名称对应的mahonia编码名称，不认识时返回""
+//mahonia没有EUC-KR，这样的页面不会被解码
+func CharsetName(label string) string {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	if label == "" {
+		return ""
+	}
+	if name, ok := charsetAliases[label]; ok {
+		return name
+	}
+	if charset := mahonia.GetCharset(label); charset != nil {
+		return charset.Name
+	}
+	return ""
+}
+
+//body的编码，依次根据BOM、Content-Type、HTML的meta判断
+//都没有时UTF-8的内容返回UTF-8，否则按中文网站最常见的GB18030处理(GBK和GB2312的超集)
+func detectCharset(header http.Header, body []byte) string {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xef, 0xbb, 0xbf}):
+		return "UTF-8"
+	case bytes.HasPrefix(body, []byte{0xff, 0xfe}):
+		return "UTF-16LE"
+	case bytes.HasPrefix(body, []byte{0xfe, 0xff}):
+		return "UTF-16BE"
+	}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		if charset := CharsetName(params["charset"]); charset != "" {
+			return charset
+		}
+	}
+	prescan := body
+	if len(prescan) > charsetPrescan {
+		prescan = prescan[:charsetPrescan]
+	}
+	if m := metaCharsetRe.FindSubmatch(prescan); m != nil {
+		if charset := CharsetName(string(m[1])); charset != "" {
+			return charset
+		}
+	}
+	if utf8.Valid(body) {
+		return "UTF-8"
+	}
+	return "GB18030"
+}
+
+//DecodeBody 把body解码成UTF-8，返回解码使用的编码
+func DecodeBody(header http.Header, body []byte) (string, string) {
+	charset := detectCharset(header, body)
+	switch {
+	case bytes.HasPrefix(body, []byte{0xef, 0xbb, 0xbf}):
+		body = body[3:]
+	case bytes.HasPrefix(body, []byte{0xff, 0xfe}), bytes.HasPrefix(body, []byte{0xfe, 0xff}):
+		body = body[2:]
+	}
+	if charset == "UTF-8" || charset == "US-ASCII" {
+		return string(body), charset
+	}
+	return mahonia.NewDecoder(charset).ConvertString(string(body)), charset
+}
@@ -74,7 +74,7 @@ func main() {
 	if err != nil {
 		return
 	}
-	//返回值只能读取一次
+	//body已经缓存，可以多次读取
 	//返回内容字符串
 	fmt.Println(resp.Text())
 	//json
@@ -0,0 +1,595 @@
+package requests
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//HAR 1.2格式，http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	//text不是UTF-8时是base64编码，HAR 1.2没有这个字段，是常用的扩展
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+//单位毫秒，-1表示没有这个阶段
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+const (
+	//记录的body最大大小，超过的部分不记录
+	maxHARBody = DefaultMaxSize
+	//固定长度，按字符串排序就是按时间排序
+	harTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+//HARRecorder 记录经过中间件的请求和响应，可以被多个client和goroutine同时使用
+type HARRecorder struct {
+	mu      sync.Mutex
+	entries []HAREntry
+}
+
+func NewHARRecorder() *HARRecorder {
+	return &HARRecorder{}
+}
+
+//记录请求
+//使用WithHARRecorder时在中间件的最内层，重试、认证、跳转的每次请求都会被记录
+func WithHARRecorder(recorder *HARRecorder) DialOption {
+	return func(opts *dialOptions) {
+		opts.har = recorder
+	}
+}
+
+//替换client的transport，在transport上记录，跳转的每一跳都是一条记录
+//raw请求不经过transport，按实际发送的内容记录
+func (h *HARRecorder) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			if _, ok := rawPayload(request.Context()); ok {
+				return h.record(request, func(request *http.Request) (*http.Response, error) {
+					return next(client, request)
+				})
+			}
+			c := *client
+			c.Transport = h.Transport(client.Transport)
+			return next(&c, request)
+		}
+	}
+}
+
+//Transport 返回记录每个请求的transport，base为nil时使用http.DefaultTransport
+//记录的header是实际发送的，包括jar的Cookie和transport添加的User-Agent、Accept-Encoding
+func (h *HARRecorder) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &harTransport{recorder: h, base: base}
+}
+
+type harTransport struct {
+	recorder *HARRecorder
+	base     http.RoundTripper
+}
+
+func (t *harTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return t.recorder.record(request, t.base.RoundTrip)
+}
+
+//transport写入的header，按写入的顺序
+type wroteHeaders struct {
+	mu      sync.Mutex
+	headers []HARNameValue
+}
+
+func (w *wroteHeaders) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		WroteHeaderField: func(key string, values []string) {
+			w.mu.Lock()
+			for _, value := range values {
+				w.headers = append(w.headers, HARNameValue{Name: key, Value: value})
+			}
+			w.mu.Unlock()
+		},
+	}
+}
+
+func (w *wroteHeaders) get() []HARNameValue {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.headers
+}
+
+func (h *HARRecorder) record(request *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	start := time.Now()
+	trace := newTracer()
+	wrote := &wroteHeaders{}
+	ctx := httptrace.WithClientTrace(request.Context(), trace.clientTrace())
+	request = request.WithContext(httptrace.WithClientTrace(ctx, wrote.clientTrace()))
+
+	resp, err := send(request)
+	entry := HAREntry{
+		StartedDateTime: start.Format(harTimeFormat),
+		Request:         harRequest(request, wrote.get()),
+		Timings:         HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+	}
+	if err != nil {
+		entry.Comment = err.Error()
+		entry.Response = HARResponse{Cookies: []HARCookie{}, Headers: []HARNameValue{}}
+	} else {
+		var body []byte
+		body, resp.Body = peekBody(resp.Body)
+		entry.Response = harResponse(resp, body)
+	}
+
+	trace.mu.Lock()
+	if trace.dns > 0 {
+		entry.Timings.DNS = milliseconds(trace.dns)
+	}
+	if trace.connect > 0 {
+		entry.Timings.Connect = milliseconds(trace.connect)
+	}
+	if trace.tls > 0 {
+		entry.Timings.SSL = milliseconds(trace.tls)
+	}
+	if !trace.firstByte.IsZero() {
+		entry.Timings.Wait = milliseconds(trace.firstByte.Sub(start))
+		entry.Timings.Receive = milliseconds(time.Since(trace.firstByte))
+	} else {
+		entry.Timings.Wait = milliseconds(time.Since(start))
+	}
+	if host, _, err := net.SplitHostPort(trace.remote); err == nil {
+		entry.ServerIPAddress = host
+	}
+	trace.mu.Unlock()
+	entry.Time = milliseconds(time.Since(start))
+
+	h.mu.Lock()
+	h.entries = append(h.entries, entry)
+	h.mu.Unlock()
+	return resp, err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+//读取body用于记录，返回的ReadCloser可以再次读取完整的body
+func peekBody(body io.ReadCloser) ([]byte, io.ReadCloser) {
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxHARBody))
+	rest := io.Reader(body)
+	if err != nil {
+		rest = &errReader{err: err}
+	}
+	return buf, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), rest), body}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+//所有记录，按开始时间排序
+func (h *HARRecorder) HAR() *HAR {
+	h.mu.Lock()
+	entries := append([]HAREntry(nil), h.entries...)
+	h.mu.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime < entries[j].StartedDateTime
+	})
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "heaven/requests", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+func (h *HARRecorder) WriteTo(w io.Writer) (int64, error) {
+	buf, err := json.MarshalIndent(h.HAR(), "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(buf, '\n'))
+	return int64(n), err
+}
+
+func (h *HARRecorder) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := h.WriteTo(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//wrote是transport实际写入的header，没有时使用请求的header
+func harRequest(request *http.Request, wrote []HARNameValue) HARRequest {
+	header := request.Header
+	proto := request.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	body := harRequestBody(request)
+	if raw, ok := rawPayload(request.Context()); ok {
+		//raw请求记录实际发送的header
+		if parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw))); err == nil {
+			header, proto = parsed.Header, parsed.Proto
+		}
+	}
+
+	har := HARRequest{
+		Method:      request.Method,
+		URL:         request.URL.String(),
+		HTTPVersion: proto,
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+	if len(wrote) > 0 {
+		har.Headers = wrote
+		header = make(http.Header)
+		for _, h := range wrote {
+			header.Add(h.Name, h.Value)
+		}
+	} else if request.Host != "" && request.Host != request.URL.Host {
+		har.Headers = append(har.Headers, HARNameValue{Name: "Host", Value: request.Host})
+	}
+	for _, c := range readCookies(header) {
+		har.Cookies = append(har.Cookies, HARCookie{Name: c.Name, Value: c.Value})
+	}
+	for name, values := range request.URL.Query() {
+		for _, value := range values {
+			har.QueryString = append(har.QueryString, HARNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(har.QueryString, func(i, j int) bool {
+		return har.QueryString[i].Name < har.QueryString[j].Name
+	})
+	if body != nil {
+		text, encoding := harText(body)
+		har.PostData = &HARPostData{MimeType: header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+	return har
+}
+
+func readCookies(header http.Header) []*http.Cookie {
+	return (&http.Request{Header: header}).Cookies()
+}
+
+//请求的body，不能重新读取时返回nil
+//raw请求是请求中header之后的内容
+func harRequestBody(request *http.Request) []byte {
+	if raw, ok := rawPayload(request.Context()); ok {
+		br := bufio.NewReader(bytes.NewReader(raw))
+		if parsed, err := http.ReadRequest(br); err == nil {
+			//按实际发送的内容记录，不按Content-Length截取
+			rest, _ := ioutil.ReadAll(io.MultiReader(parsed.Body, br))
+			if len(rest) == 0 {
+				return nil
+			}
+			return rest
+		}
+		return raw
+	}
+	if request.GetBody == nil {
+		return nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	buf, _ := ioutil.ReadAll(body)
+	if len(buf) == 0 {
+		return nil
+	}
+	return buf
+}
+
+//按Content-Encoding解压body，不支持的编码或者解压失败(eg: body被截断)时返回原内容
+func harContent(contentEncoding string, body []byte) []byte {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		//deflate应该是zlib格式，很多服务端发送的是原始的deflate
+		if r, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body
+	}
+	if err != nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+func harResponse(resp *http.Response, body []byte) HARResponse {
+	//调用方自己设置Accept-Encoding时transport不会解压，HAR中记录解压后的内容
+	content := harContent(resp.Header.Get("Content-Encoding"), body)
+	text, encoding := harText(content)
+	har := HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(resp.Header),
+		Content: HARContent{
+			Size:     int64(len(content)),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.ContentLength,
+	}
+	for _, c := range resp.Cookies() {
+		cookie := HARCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(time.RFC3339)
+		}
+		har.Cookies = append(har.Cookies, cookie)
+	}
+	return har
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+//不是UTF-8的内容使用base64
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harDecode(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+//HAR中没有对应的记录
+var ErrHARNotFound = errors.New("requests: no matching HAR entry")
+
+//HARReplay 从HAR文件返回响应的transport，不会发送任何请求
+//按方法、url和body匹配记录，相同的请求有多条记录时按顺序返回，最后一条会一直重复
+type HARReplay struct {
+	mu      sync.Mutex
+	entries map[string][]*HAREntry
+	served  map[string]int
+}
+
+func LoadHAR(path string) (*HARReplay, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har HAR
+	if err := json.Unmarshal(buf, &har); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewHARReplay(&har)
+}
+
+func NewHARReplay(har *HAR) (*HARReplay, error) {
+	r := &HARReplay{entries: make(map[string][]*HAREntry), served: make(map[string]int)}
+	for i := range har.Log.Entries {
+		entry := &har.Log.Entries[i]
+		var body []byte
+		if entry.Request.PostData != nil {
+			var err error
+			if body, err = harDecode(entry.Request.PostData.Text, entry.Request.PostData.Encoding); err != nil {
+				return nil, fmt.Errorf("entry %d: %w", i, err)
+			}
+		}
+		key, err := harKey(entry.Request.Method, entry.Request.URL, body)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		r.entries[key] = append(r.entries[key], entry)
+	}
+	return r, nil
+}
+
+func harKey(method, rawurl string, body []byte) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	u.Fragment = ""
+	sum := sha256.Sum256(body)
+	return strings.ToUpper(method) + " " + u.String() + " " + fmt.Sprintf("%x", sum[:8]), nil
+}
+
+func (r *HARReplay) RoundTrip(request *http.Request) (*http.Response, error) {
+	key, err := harKey(request.Method, request.URL.String(), harRequestBody(request))
+	if err != nil {
+		return nil, err
+	}
+	if request.Body != nil {
+		_ = request.Body.Close()
+	}
+
+	r.mu.Lock()
+	entries := r.entries[key]
+	i := r.served[key]
+	if i < len(entries)-1 {
+		r.served[key]++
+	}
+	r.mu.Unlock()
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrHARNotFound, request.Method, request.URL)
+	}
+	entry := entries[i]
+
+	body, err := harDecode(entry.Response.Content.Text, entry.Response.Content.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	for _, h := range entry.Response.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	//HAR中记录的是解码后的内容
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", fmt.Sprint(len(body)))
+	if entry.Response.Content.MimeType != "" && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", entry.Response.Content.MimeType)
+	}
+
+	proto := entry.Response.HTTPVersion
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		proto, major, minor = "HTTP/1.1", 1, 1
+	}
+	status := fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText)
+	if entry.Response.StatusText == "" {
+		status = fmt.Sprintf("%d %s", entry.Response.Status, http.StatusText(entry.Response.Status))
+	}
+	return &http.Response{
+		Status:        strings.TrimSpace(status),
+		StatusCode:    entry.Response.Status,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}, nil
+}
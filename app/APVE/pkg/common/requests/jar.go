@@ -0,0 +1,388 @@
+package requests
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+//JarCookie jar中保存的cookie
+type JarCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	//没有设置Domain属性，只发送给Domain这个host，不发送给子域名
+	HostOnly bool `json:"hostOnly,omitempty"`
+	Secure   bool `json:"secure,omitempty"`
+	HttpOnly bool `json:"httpOnly,omitempty"`
+	//为0时是会话cookie，同样会被保存
+	Expires time.Time `json:"expires,omitempty"`
+	Created time.Time `json:"created"`
+	//创建时间相同时按设置的顺序排列
+	seq uint64
+}
+
+func (c *JarCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+//是否发送给host
+func (c *JarCookie) domainMatch(host string) bool {
+	if c.HostOnly {
+		return host == c.Domain
+	}
+	return host == c.Domain || strings.HasSuffix(host, "."+c.Domain)
+}
+
+func (c *JarCookie) pathMatch(path string) bool {
+	if path == c.Path {
+		return true
+	}
+	if strings.HasPrefix(path, c.Path) {
+		return strings.HasSuffix(c.Path, "/") || path[len(c.Path)] == '/'
+	}
+	return false
+}
+
+//CookieJar 可以保存到文件的cookie jar，可以在多个client和goroutine之间共享
+//按RFC 6265匹配域名和路径，不接受设置到公共后缀(eg: com.cn)上的cookie
+type CookieJar struct {
+	mu sync.Mutex
+	//domain -> name;path -> cookie
+	cookies map[string]map[string]*JarCookie
+	seq     uint64
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{cookies: make(map[string]map[string]*JarCookie)}
+}
+
+//从文件加载，文件不存在时返回空的jar
+func LoadCookieJar(path string) (*CookieJar, error) {
+	jar := NewCookieJar()
+	buf, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return jar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, jar); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+//保存到文件，先写临时文件再重命名，写入失败不会破坏原来的文件
+func (j *CookieJar) Save(path string) error {
+	buf, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+//所有没有过期的cookie
+func (j *CookieJar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Entries(""))
+}
+
+//加载的cookie会合并到jar中，已经过期的会被丢弃
+func (j *CookieJar) UnmarshalJSON(data []byte) error {
+	var entries []JarCookie
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cookies == nil {
+		j.cookies = make(map[string]map[string]*JarCookie)
+	}
+	for i := range entries {
+		c := entries[i]
+		if c.expired(now) || c.Domain == "" {
+			continue
+		}
+		j.put(&c)
+	}
+	return nil
+}
+
+func (j *CookieJar) put(c *JarCookie) {
+	if c.seq == 0 {
+		j.seq++
+		c.seq = j.seq
+	}
+	cookies := j.cookies[c.Domain]
+	if cookies == nil {
+		cookies = make(map[string]*JarCookie)
+		j.cookies[c.Domain] = cookies
+	}
+	cookies[c.Name+";"+c.Path] = c
+}
+
+//实现http.CookieJar
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host, err := canonicalHost(u.Host)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, cookie := range cookies {
+		c, ok := newJarCookie(host, u.Path, cookie, now)
+		if !ok {
+			continue
+		}
+		id := c.Name + ";" + c.Path
+		old := j.cookies[c.Domain][id]
+		//Max-Age<=0或者Expires是过去的时间表示删除
+		if c.expired(now) {
+			delete(j.cookies[c.Domain], id)
+			continue
+		}
+		if old != nil {
+			c.Created, c.seq = old.Created, old.seq
+		}
+		j.put(c)
+	}
+}
+
+func newJarCookie(host, path string, cookie *http.Cookie, now time.Time) (*JarCookie, bool) {
+	c := &JarCookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   host,
+		Path:     cookie.Path,
+		HostOnly: true,
+		Secure:   cookie.Secure,
+		HttpOnly: cookie.HttpOnly,
+		Created:  now,
+	}
+	if domain := strings.TrimPrefix(strings.ToLower(cookie.Domain), "."); domain != "" && domain != host {
+		//IP地址不能设置Domain，其他host只能设置为自己或者上级域名
+		if net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+domain) {
+			return nil, false
+		}
+		if suffix, _ := publicsuffix.PublicSuffix(domain); suffix == domain {
+			return nil, false
+		}
+		c.Domain, c.HostOnly = domain, false
+	} else if domain != "" && net.ParseIP(host) == nil {
+		c.HostOnly = false
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		c.Path = defaultPath(path)
+	}
+	switch {
+	case cookie.MaxAge < 0:
+		c.Expires = now
+	case cookie.MaxAge > 0:
+		c.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+	case !cookie.Expires.IsZero():
+		c.Expires = cookie.Expires
+		if !c.Expires.After(now) {
+			c.Expires = now
+		}
+	}
+	return c, true
+}
+
+//RFC 6265 5.1.4，请求路径的目录
+func defaultPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func canonicalHost(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return "", errors.New("requests: empty host")
+	}
+	return host, nil
+}
+
+//实现http.CookieJar，路径长的排在前面
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host, err := canonicalHost(u.Host)
+	if err != nil {
+		return nil
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	now := time.Now()
+
+	var matched []*JarCookie
+	j.mu.Lock()
+	for domain, cookies := range j.cookies {
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+		for id, c := range cookies {
+			if c.expired(now) {
+				delete(cookies, id)
+				continue
+			}
+			if c.domainMatch(host) && c.pathMatch(path) && (secure || !c.Secure) {
+				matched = append(matched, c)
+			}
+		}
+	}
+	j.mu.Unlock()
+
+	sort.SliceStable(matched, func(a, b int) bool {
+		if len(matched[a].Path) != len(matched[b].Path) {
+			return len(matched[a].Path) > len(matched[b].Path)
+		}
+		if !matched[a].Created.Equal(matched[b].Created) {
+			return matched[a].Created.Before(matched[b].Created)
+		}
+		return matched[a].seq < matched[b].seq
+	})
+	cookies := make([]*http.Cookie, 0, len(matched))
+	for _, c := range matched {
+		cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
+
+//target的cookie，不区分路径和协议，target为空时返回所有cookie
+//target可以是url或者host
+func (j *CookieJar) Entries(target string) []JarCookie {
+	host := targetHost(target)
+	now := time.Now()
+	var entries []JarCookie
+	j.mu.Lock()
+	for _, cookies := range j.cookies {
+		for _, c := range cookies {
+			if !c.expired(now) && (host == "" || c.domainMatch(host)) {
+				entries = append(entries, *c)
+			}
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(entries, func(a, b int) bool {
+		x, y := entries[a], entries[b]
+		if x.Domain != y.Domain {
+			return x.Domain < y.Domain
+		}
+		if x.Path != y.Path {
+			return x.Path < y.Path
+		}
+		return x.Name < y.Name
+	})
+	return entries
+}
+
+//删除target的cookie，target为空时清空jar
+func (j *CookieJar) Clear(target string) {
+	host := targetHost(target)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if host == "" {
+		j.cookies = make(map[string]map[string]*JarCookie)
+		return
+	}
+	for _, cookies := range j.cookies {
+		for id, c := range cookies {
+			if c.domainMatch(host) {
+				delete(cookies, id)
+			}
+		}
+	}
+}
+
+func targetHost(target string) string {
+	if target == "" {
+		return ""
+	}
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		target = u.Host
+	}
+	host, _ := canonicalHost(target)
+	return host
+}
+
+//使用jar保存cookie，同时开启session
+//同一个jar可以给多个client使用，在它们之间共享登录状态
+func WithCookieJar(jar *CookieJar) DialOption {
+	return func(opts *dialOptions) {
+		opts.jar = jar
+		opts.session = true
+	}
+}
+
+//client使用的cookie jar，没有开启session时返回nil
+func (req *Client) CookieJar() *CookieJar {
+	jar, _ := req.opts.client.Jar.(*CookieJar)
+	return jar
+}
+
+//记录跳转过程中每个响应设置的cookie，登录请求通常在302中设置cookie
+type redirectCookies struct {
+	mu      sync.Mutex
+	cookies []*http.Cookie
+}
+
+//返回记录cookie的client副本，不改变原来的跳转策略
+func (r *redirectCookies) wrap(client *http.Client) *http.Client {
+	c := *client
+	check := client.CheckRedirect
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.Response != nil {
+			r.mu.Lock()
+			r.cookies = append(r.cookies, req.Response.Cookies()...)
+			r.mu.Unlock()
+		}
+		if check != nil {
+			return check(req, via)
+		}
+		//和http.Client默认的策略相同
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &c
+}
+
+func (r *redirectCookies) get() []*http.Cookie {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cookies
+}
@@ -0,0 +1,333 @@
+package requests
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//目标返回429/503后暂停请求的时间，连续出现时翻倍
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	//记录的host超过这个数量时清理空闲的host
+	maxIdleHosts = 4096
+)
+
+//速率和并发限制，值小于等于0表示不限制
+type Limit struct {
+	//每秒请求数
+	Rate float64
+	//令牌桶容量，即允许的突发请求数，默认1
+	Burst int
+	//同时进行的请求数
+	MaxInFlight int
+}
+
+//Limiter 按host和全局限制请求的速率和并发数
+//同一个Limiter可以被多个client共用，共用的client一起被限制
+//目标返回429或503时会暂停该host的请求，优先使用Retry-After指定的时间
+type Limiter struct {
+	global  limitState
+	perHost Limit
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type limitState struct {
+	bucket *bucket
+	slots  chan struct{}
+}
+
+type hostState struct {
+	limitState
+	//正在使用的请求数，为0时才可以清理
+	users int
+	//连续的429/503次数
+	throttled int
+}
+
+func newLimitState(limit Limit) limitState {
+	var state limitState
+	if limit.Rate > 0 {
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		state.bucket = &bucket{rate: limit.Rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	}
+	if limit.MaxInFlight > 0 {
+		state.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return state
+}
+
+func NewLimiter(global, perHost Limit) *Limiter {
+	return &Limiter{
+		global:  newLimitState(global),
+		perHost: perHost,
+		hosts:   make(map[string]*hostState),
+	}
+}
+
+//限流中间件
+//使用WithLimiter时限流在重试之后执行，每次重试也会被限制
+func (l *Limiter) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			host, err := l.acquire(request.Context(), request.URL.Host)
+			if err != nil {
+				return nil, err
+			}
+			defer l.done(host)
+
+			resp, err := next(client, request)
+			if err == nil {
+				l.observe(host, resp)
+			}
+			return resp, err
+		}
+	}
+}
+
+//Transport 返回限流的transport，没有使用Client的请求也可以被限制，跳转的每一跳都会被限制
+func (l *Limiter) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	send := l.Middleware()(func(_ *http.Client, request *http.Request) (*http.Response, error) {
+		return base.RoundTrip(request)
+	})
+	return roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		return send(nil, request)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+//Wait 等待host和全局的令牌和并发，用于限制不是HTTP的连接(eg: 读取banner)
+//host通常是host:port，返回的done在连接结束时调用
+func (l *Limiter) Wait(ctx context.Context, host string) (done func(), err error) {
+	state, err := l.acquire(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return func() { l.done(state) }, nil
+}
+
+//依次等待host和全局的令牌、并发，出错时已经释放
+func (l *Limiter) acquire(ctx context.Context, key string) (*hostState, error) {
+	host := l.host(strings.ToLower(key))
+	if err := l.wait(ctx, l.bucket(host)); err != nil {
+		l.release(host)
+		return nil, err
+	}
+	if err := l.wait(ctx, l.global.bucket); err != nil {
+		l.release(host)
+		return nil, err
+	}
+	//先获取host的并发再获取全局的，避免占着全局并发等待host
+	if err := acquire(ctx, host.slots); err != nil {
+		l.release(host)
+		return nil, err
+	}
+	if err := acquire(ctx, l.global.slots); err != nil {
+		release(host.slots)
+		l.release(host)
+		return nil, err
+	}
+	return host, nil
+}
+
+func (l *Limiter) done(host *hostState) {
+	release(l.global.slots)
+	release(host.slots)
+	l.release(host)
+}
+
+func (l *Limiter) host(key string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	host, ok := l.hosts[key]
+	if !ok {
+		if len(l.hosts) >= maxIdleHosts {
+			l.prune(time.Now())
+		}
+		host = &hostState{limitState: newLimitState(l.perHost)}
+		l.hosts[key] = host
+	}
+	host.users++
+	return host
+}
+
+//host的令牌桶，没有限制速率的host在第一次429/503时才创建
+func (l *Limiter) bucket(host *hostState) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return host.bucket
+}
+
+func (l *Limiter) release(host *hostState) {
+	l.mu.Lock()
+	host.users--
+	l.mu.Unlock()
+}
+
+//清理没有在使用，也不再影响之后请求的host
+func (l *Limiter) prune(now time.Time) {
+	for key, host := range l.hosts {
+		if host.users == 0 && (host.bucket == nil || host.bucket.idle(now)) {
+			delete(l.hosts, key)
+		}
+	}
+}
+
+//等待一个令牌，ctx结束时归还令牌
+func (l *Limiter) wait(ctx context.Context, b *bucket) error {
+	if b == nil {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	delay := b.reserve(time.Now())
+	l.mu.Unlock()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		b.cancel()
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+//429/503时暂停host的请求
+func (l *Limiter) observe(host *hostState, resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		host.throttled = 0
+		return
+	}
+	host.throttled++
+	if host.bucket == nil {
+		//没有限制速率的host也需要暂停，使用一个不限制速率的桶
+		host.bucket = &bucket{rate: math.Inf(1), burst: 1, tokens: 1, last: time.Now()}
+	}
+
+	delay, ok := retryAfter(resp)
+	if !ok {
+		delay = minBackoff << uint(host.throttled-1)
+	}
+	if delay > maxBackoff || delay < 0 {
+		delay = maxBackoff
+	}
+	if until := time.Now().Add(delay); until.After(host.bucket.paused) {
+		host.bucket.paused = until
+	}
+}
+
+func acquire(ctx context.Context, slots chan struct{}) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+//retryAfter 解析Retry-After，支持秒数和HTTP日期
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+//令牌桶，令牌可以预支，tokens为负数时需要等待
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	//在这之前不发放令牌
+	paused time.Time
+}
+
+func (b *bucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+//取一个令牌，返回需要等待的时间
+func (b *bucket) reserve(now time.Time) time.Duration {
+	if b.last.Before(b.paused) {
+		//暂停期间不积累令牌
+		b.last = b.paused
+	}
+	b.advance(now)
+	b.tokens--
+
+	//last不早于now，暂停时是暂停结束的时间
+	delay := b.last.Sub(now)
+	if b.tokens < 0 {
+		delay += time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	return delay
+}
+
+func (b *bucket) cancel() {
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+func (b *bucket) idle(now time.Time) bool {
+	b.advance(now)
+	return b.tokens >= b.burst && !now.Before(b.paused)
+}
+
+//设置限流，同一个Limiter可以给多个client使用
+func WithLimiter(limiter *Limiter) DialOption {
+	return func(opts *dialOptions) {
+		opts.limiter = limiter
+	}
+}
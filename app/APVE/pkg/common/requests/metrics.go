@@ -0,0 +1,185 @@
+package requests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//Metrics 请求的prometheus指标，按host和module(eg: PoC的名称)区分
+//实现了prometheus.Collector，eg: prometheus.MustRegister(metrics)
+//host的数量就是时间序列的数量，扫描大量目标时注意指标的规模
+type Metrics struct {
+	phases   *prometheus.HistogramVec
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	inflight *prometheus.GaugeVec
+}
+
+//namespace为指标名称的前缀，eg: apve
+func NewMetrics(namespace string) *Metrics {
+	labels := []string{"host", "module"}
+	return &Metrics{
+		phases: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "requests",
+			Name:      "phase_seconds",
+			Help:      "Duration of each request phase: dns, connect, tls, first_byte and total.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, append(labels, "phase")),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "requests",
+			Name:      "responses_total",
+			Help:      "Responses received, by status code.",
+		}, append(labels, "code")),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "requests",
+			Name:      "errors_total",
+			Help:      "Requests that failed without a response, by reason.",
+		}, append(labels, "reason")),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "requests",
+			Name:      "in_flight",
+			Help:      "Requests waiting for a response or reading the body.",
+		}, labels),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.phases.Describe(ch)
+	m.requests.Describe(ch)
+	m.errors.Describe(ch)
+	m.inflight.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.phases.Collect(ch)
+	m.requests.Collect(ch)
+	m.errors.Collect(ch)
+	m.inflight.Collect(ch)
+}
+
+//记录请求的指标
+//使用WithMetrics时在中间件的最内层，每次重试都会被记录
+func WithMetrics(metrics *Metrics, module string) DialOption {
+	return func(opts *dialOptions) {
+		opts.metrics = metrics.Middleware(module)
+	}
+}
+
+//total从开始请求到读取完body或者关闭body
+func (m *Metrics) Middleware(module string) Middleware {
+	return func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			host := request.URL.Host
+			inflight := m.inflight.WithLabelValues(host, module)
+			inflight.Inc()
+			trace := newTracer()
+			request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace.clientTrace()))
+
+			resp, err := next(client, request)
+			observe := func(total time.Duration) {
+				inflight.Dec()
+				record := func(phase string, d time.Duration) {
+					//复用的连接没有dns、connect和tls阶段
+					if d > 0 {
+						m.phases.WithLabelValues(host, module, phase).Observe(d.Seconds())
+					}
+				}
+				trace.mu.Lock()
+				record("dns", trace.dns)
+				record("connect", trace.connect)
+				record("tls", trace.tls)
+				if !trace.firstByte.IsZero() {
+					record("first_byte", trace.firstByte.Sub(trace.start))
+				}
+				trace.mu.Unlock()
+				record("total", total)
+			}
+
+			if err != nil {
+				m.errors.WithLabelValues(host, module, errorReason(err)).Inc()
+				observe(time.Since(trace.start))
+				return resp, err
+			}
+			m.requests.WithLabelValues(host, module, strconv.Itoa(resp.StatusCode)).Inc()
+			if resp.Body == nil {
+				observe(time.Since(trace.start))
+				return resp, err
+			}
+			resp.Body = &metricsBody{ReadCloser: resp.Body, start: trace.start, observe: observe}
+			return resp, err
+		}
+	}
+}
+
+//读取完或者关闭时记录总耗时
+type metricsBody struct {
+	io.ReadCloser
+	start   time.Time
+	once    sync.Once
+	observe func(time.Duration)
+}
+
+func (b *metricsBody) done() {
+	b.once.Do(func() {
+		b.observe(time.Since(b.start))
+	})
+}
+
+func (b *metricsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *metricsBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+//错误的分类，用作指标的标签
+func errorReason(err error) string {
+	var (
+		dnsErr     *net.DNSError
+		opErr      *net.OpError
+		certErr    x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		recordErr  tls.RecordHeaderError
+		netErr     net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &invalidErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	return "other"
+}
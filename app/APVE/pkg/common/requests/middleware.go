@@ -3,7 +3,6 @@ package requests
 import (
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/http/httputil"
 )
 
@@ -23,7 +22,9 @@ func Chain(middles ...Middleware) Middleware {
 func loggerMiddleware() Middleware {
 	return func(next Handler) Handler {
 		return func(client *http.Client, request *http.Request) (*http.Response, error) {
-			if buf, err := httputil.DumpRequest(request, true); err == nil {
+			if raw, ok := rawPayload(request.Context()); ok {
+				log.Printf("[request]\n%s\n", raw)
+			} else if buf, err := httputil.DumpRequest(request, true); err == nil {
 				log.Printf("[request]\n%s\n", buf)
 			}
 			resp, err := next(client, request)
@@ -39,11 +40,26 @@ func loggerMiddleware() Middleware {
 	}
 }
 
+//重试时使用GetBody重新生成body，body不能重新读取的请求只发送一次
 func retryMiddleware(retry *retry) Middleware {
 	return func(next Handler) Handler {
-		return func(client *http.Client, request *http.Request) (response *http.Response, err error) {
-			return retry.backoff(func() (response *http.Response, err error) {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
 				return next(client, request)
+			}
+			return retry.backoff(request.Context(), func(attempt int) (*http.Response, error) {
+				if attempt == 0 {
+					return next(client, request)
+				}
+				req := request.Clone(request.Context())
+				if request.GetBody != nil {
+					body, err := request.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					req.Body = body
+				}
+				return next(client, req)
 			})
 		}
 	}
@@ -60,15 +76,12 @@ func headerMiddleware(headers Value) Middleware {
 	}
 }
 
+//cookie只添加到当前请求，不保存到client的jar中
 func cookieMiddleware(cookies ...*http.Cookie) Middleware {
 	return func(next Handler) Handler {
 		return func(client *http.Client, request *http.Request) (response *http.Response, err error) {
-			if len(cookies) > 0 {
-				if client.Jar == nil {
-					jar, _ := cookiejar.New(nil)
-					client.Jar = jar
-				}
-				client.Jar.SetCookies(request.URL, cookies)
+			for _, cookie := range cookies {
+				request.AddCookie(cookie)
 			}
 			return next(client, request)
 		}
@@ -0,0 +1,221 @@
+package requests
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+)
+
+//Part multipart/form-data中的一个部分
+//内容按Content、Reader、Path的顺序取第一个设置了的，都没有设置时是空内容
+type Part struct {
+	Name string
+	//为空时不带filename，是普通的字段
+	Filename string
+	//为空时文件使用application/octet-stream，字段不带Content-Type
+	ContentType string
+	//额外的header，设置了Content-Disposition时原样使用，不再生成
+	Header textproto.MIMEHeader
+
+	Content []byte
+	//只能读取一次，包含Reader的请求不会重试
+	Reader io.Reader
+	//发送时才打开文件
+	Path string
+}
+
+//普通字段
+func FieldPart(name, value string) *Part {
+	return &Part{Name: name, Content: []byte(value)}
+}
+
+//内存中的文件
+func BytesPart(name, filename string, content []byte) *Part {
+	return &Part{Name: name, Filename: filename, Content: content}
+}
+
+//从r读取的文件，r只能读取一次
+func ReaderPart(name, filename string, r io.Reader) *Part {
+	return &Part{Name: name, Filename: filename, Reader: r}
+}
+
+//本地文件，filename为文件名
+func FilePart(name, path string) *Part {
+	return &Part{Name: name, Filename: filepath.Base(path), Path: path}
+}
+
+//multipart/form-data上传，parts按顺序发送
+//body在发送时通过io.Pipe生成，不会整个读到内存中
+//name和filename原样写入Content-Disposition，不做转义，可以构造恶意的文件名
+func WithMultipart(parts ...*Part) DialOption {
+	return func(opts *dialOptions) {
+		m, err := newMultipartBody(parts)
+		if err != nil {
+			opts.err = err
+			return
+		}
+		opts.upload = m
+		opts.body = nil
+		opts.payload = nil
+		opts.setContentType(m.contentType())
+	}
+}
+
+type multipartBody struct {
+	parts    []*Part
+	boundary string
+	//-1表示长度未知，使用chunked发送
+	length int64
+	//没有Reader时可以重新生成body
+	replayable bool
+}
+
+func newMultipartBody(parts []*Part) (*multipartBody, error) {
+	m := &multipartBody{
+		parts:      parts,
+		boundary:   multipart.NewWriter(nil).Boundary(),
+		replayable: true,
+	}
+
+	//写入header计算长度，内容的长度单独累加
+	var size int64
+	counter := &countWriter{}
+	writer := multipart.NewWriter(counter)
+	_ = writer.SetBoundary(m.boundary)
+	for _, part := range parts {
+		if _, err := writer.CreatePart(part.header()); err != nil {
+			return nil, err
+		}
+		n, err := part.size()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || size < 0 {
+			size = -1
+		} else {
+			size += n
+		}
+		if part.Content == nil && part.Reader != nil {
+			m.replayable = false
+		}
+	}
+	_ = writer.Close()
+	m.length = -1
+	if size >= 0 {
+		m.length = counter.n + size
+	}
+	return m, nil
+}
+
+func (m *multipartBody) contentType() string {
+	return "multipart/form-data; boundary=" + m.boundary
+}
+
+//设置请求的body，内容在另一个goroutine中写入
+func (m *multipartBody) apply(request *http.Request) {
+	request.Body = m.open()
+	request.ContentLength = m.length
+	if m.replayable {
+		request.GetBody = func() (io.ReadCloser, error) {
+			return m.open(), nil
+		}
+	}
+}
+
+func (m *multipartBody) open() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.writeTo(pw))
+	}()
+	return pr
+}
+
+func (m *multipartBody) writeTo(w io.Writer) error {
+	writer := multipart.NewWriter(w)
+	_ = writer.SetBoundary(m.boundary)
+	for _, part := range m.parts {
+		pw, err := writer.CreatePart(part.header())
+		if err != nil {
+			return err
+		}
+		if err := part.writeTo(pw); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func (p *Part) header() textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	for k, v := range p.Header {
+		h[k] = v
+	}
+	if h.Get("Content-Disposition") == "" {
+		disposition := fmt.Sprintf(`form-data; name="%s"`, p.Name)
+		if p.Filename != "" {
+			disposition += fmt.Sprintf(`; filename="%s"`, p.Filename)
+		}
+		h.Set("Content-Disposition", disposition)
+	}
+	if h.Get("Content-Type") == "" {
+		if p.ContentType != "" {
+			h.Set("Content-Type", p.ContentType)
+		} else if p.Filename != "" {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+	}
+	return h
+}
+
+//内容长度，无法知道时返回-1
+func (p *Part) size() (int64, error) {
+	switch {
+	case p.Content != nil:
+		return int64(len(p.Content)), nil
+	case p.Reader != nil:
+		if r, ok := p.Reader.(interface{ Len() int }); ok {
+			return int64(r.Len()), nil
+		}
+		return -1, nil
+	case p.Path != "":
+		info, err := os.Stat(p.Path)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	return 0, nil
+}
+
+func (p *Part) writeTo(w io.Writer) error {
+	switch {
+	case p.Content != nil:
+		_, err := w.Write(p.Content)
+		return err
+	case p.Reader != nil:
+		_, err := io.Copy(w, p.Reader)
+		return err
+	case p.Path != "":
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	return nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -2,14 +2,15 @@ package requests
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"io"
-	"mime/multipart"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptrace"
-	"os"
-	"path/filepath"
+	"net/url"
 )
 
 type (
@@ -29,12 +30,87 @@ type dialOptions struct {
 	cookies []*http.Cookie
 	query   string
 	body    io.Reader
+	payload []byte
+	raw     []byte
+	//multipart在发送时生成body
+	upload  *multipartBody
 	session bool
+	jar     *CookieJar
+	proxy   *url.URL
+	tls     *tls.Config
 	middles []Middleware
 	retry   Middleware
+	auth    Middleware
+	limiter *Limiter
+	har     *HARRecorder
+	metrics Middleware
+	maxSize int64
 	trace   *httptrace.ClientTrace
 }
 
+//复制一份配置，切片和map不与原配置共享
+func (opts dialOptions) clone() dialOptions {
+	o := opts
+	if opts.headers != nil {
+		o.headers = make(Value, len(opts.headers))
+		for k, v := range opts.headers {
+			o.headers[k] = v
+		}
+	}
+	o.cookies = append([]*http.Cookie(nil), opts.cookies...)
+	o.middles = append([]Middleware(nil), opts.middles...)
+	if opts.tls != nil {
+		o.tls = opts.tls.Clone()
+	}
+	return o
+}
+
+//固定client的基础配置
+//开启session的client使用自己的cookie jar，不修改传入的client
+//基础配置中的body会被多个请求使用，所以预先读取出来
+//multipart中的Reader只能读取一次，不能放在基础配置中
+func (opts *dialOptions) freeze() {
+	if opts.client == nil {
+		opts.client = DefaultClient
+	}
+	if opts.jar != nil && opts.client.Jar != http.CookieJar(opts.jar) {
+		client := *opts.client
+		client.Jar = opts.jar
+		opts.client = &client
+	} else if opts.session && opts.client.Jar == nil {
+		client := *opts.client
+		client.Jar = NewCookieJar()
+		opts.client = &client
+	}
+	if opts.upload != nil && !opts.upload.replayable && opts.err == nil {
+		opts.err = errors.New("requests: multipart Reader parts can only be set per request")
+	}
+	if opts.body != nil && opts.err == nil {
+		buf, err := ioutil.ReadAll(opts.body)
+		if err != nil {
+			opts.err = err
+		}
+		opts.setPayload(buf)
+	}
+}
+
+//payload每次请求都创建新的reader，可以被多个请求同时使用
+func (opts *dialOptions) setPayload(payload []byte) {
+	if payload == nil {
+		payload = []byte{}
+	}
+	opts.payload = payload
+	opts.body = nil
+	opts.upload = nil
+}
+
+func (opts *dialOptions) requestBody() io.Reader {
+	if opts.payload != nil {
+		return bytes.NewReader(opts.payload)
+	}
+	return opts.body
+}
+
 func (opts *dialOptions) setContentType(contentType string) {
 	opts.setHeader("Content-Type", contentType)
 }
@@ -83,7 +159,7 @@ func WithQuery(i interface{}) DialOption {
 func WithForm(form Value) DialOption {
 	return func(opts *dialOptions) {
 		s := mapToValues(form).Encode()
-		opts.body = bytes.NewBufferString(s)
+		opts.setPayload([]byte(s))
 		opts.setContentType("application/x-www-form-urlencoded")
 	}
 }
@@ -95,7 +171,7 @@ func WithJSON(data interface{}) DialOption {
 			opts.err = err
 			return
 		}
-		opts.body = bytes.NewBuffer(buf)
+		opts.setPayload(buf)
 		opts.setContentType("application/json")
 	}
 }
@@ -107,52 +183,28 @@ func WithXML(data interface{}) DialOption {
 			opts.err = err
 			return
 		}
-		opts.body = bytes.NewBuffer(buf)
+		opts.setPayload(buf)
 		opts.setContentType("application/xml")
 	}
 }
 
 //直接设置一个请求body
+//在New中设置时body会被读取出来，供之后的每个请求使用
 func WithBody(body io.Reader) DialOption {
 	return func(opts *dialOptions) {
 		opts.body = body
+		opts.payload = nil
+		opts.upload = nil
 	}
 }
 
 //上传文件
 func WithFile(file *File) DialOption {
-	return func(opts *dialOptions) {
-		f, err := os.Open(file.Path)
-		if err != nil {
-			opts.err = err
-			return
-		}
-		defer f.Close()
-
-		var body bytes.Buffer
-		writer := multipart.NewWriter(&body)
-		part, err := writer.CreateFormFile(file.Name, filepath.Base(file.Path))
-		if err != nil {
-			opts.err = err
-			return
-		}
-		if _, err := io.Copy(part, f); err != nil {
-			opts.err = err
-			return
-		}
-
-		for k, v := range file.Extras {
-			_ = writer.WriteField(k, v)
-		}
-
-		if err := writer.Close(); err != nil {
-			opts.err = err
-			return
-		}
-
-		opts.body = &body
-		opts.setContentType(writer.FormDataContentType())
+	parts := []*Part{FilePart(file.Name, file.Path)}
+	for k, v := range file.Extras {
+		parts = append(parts, FieldPart(k, v))
 	}
+	return WithMultipart(parts...)
 }
 
 //设置请求client
@@ -163,12 +215,12 @@ func WithClient(clients ...*http.Client) DialOption {
 		if len(clients) > 0 {
 			opts.client = clients[0]
 		} else {
-			opts.client = http.DefaultClient
+			opts.client = DefaultClient
 		}
 	}
 }
 
-//设置cookie
+//设置cookie，只添加到当前请求，不会保存到jar中
 func WithCookies(cookies ...*http.Cookie) DialOption {
 	return func(opts *dialOptions) {
 		opts.middles = append(opts.middles, cookieMiddleware(cookies...))
@@ -177,6 +229,7 @@ func WithCookies(cookies ...*http.Cookie) DialOption {
 
 //是否清空cookies
 //如果设置成true，后续的请求都会带上前面请求返回的cookie，所以不要随便设置，只有在确实需要的时候再设置
+//session需要在创建client时设置，client会使用自己的cookie jar
 func WithSession(session bool) DialOption {
 	return func(opts *dialOptions) {
 		opts.session = session
@@ -184,19 +237,28 @@ func WithSession(session bool) DialOption {
 }
 
 //设置请求重试
-//自带一个默认的重试实现，可以自定义实现
+//自带一个默认的重试实现RetryConfig，可以自定义实现
+//body不能重新读取的请求不会重试
 func WithRetry(retries ...Retry) DialOption {
 	return func(opts *dialOptions) {
 		var retry Retry
 		if len(retries) > 0 {
 			retry = retries[0]
 		} else {
-			retry = &defaultRetry{}
+			retry = &RetryConfig{}
 		}
 		opts.retry = retryMiddleware(newRetry(retry))
 	}
 }
 
+//最多读取的body大小，超过的部分会被丢弃
+//默认DefaultMaxSize，小于0时不限制
+func WithMaxSize(maxSize int64) DialOption {
+	return func(opts *dialOptions) {
+		opts.maxSize = maxSize
+	}
+}
+
 //添加请求追踪
 //trace需要自定义
 func WithTrace(trace *httptrace.ClientTrace) DialOption {
@@ -0,0 +1,623 @@
+package requests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+//body的编码，mahonia的编码名称，eg: gb2312返回GBK
+func (r *Response) Charset() string {
+	if r.empty() {
+		return ""
+	}
+	return detectCharset(r.resp.Header, r.body)
+}
+
+//按Charset解码成UTF-8的内容
+func (r *Response) DecodedText() (string, error) {
+	if r.empty() {
+		return "", ErrNoResponse
+	}
+	text, _ := DecodeBody(r.resp.Header, r.body)
+	return text, nil
+}
+
+//body中是否包含s，不解码
+func (r *Response) Contains(s string) bool {
+	if r.empty() {
+		return false
+	}
+	return bytes.Contains(r.body, []byte(s))
+}
+
+//解析HTML，可以使用CSS选择器查询
+func (r *Response) Document() (*goquery.Document, error) {
+	text, err := r.DecodedText()
+	if err != nil {
+		return nil, err
+	}
+	return goquery.NewDocumentFromReader(strings.NewReader(text))
+}
+
+//使用CSS选择器查询HTML，出错时返回空的Selection
+//eg: resp.Find(`input[name="csrf_token"]`).AttrOr("value", "")
+func (r *Response) Find(selector string) *goquery.Selection {
+	doc, err := r.Document()
+	if err != nil {
+		return &goquery.Selection{}
+	}
+	return doc.Find(selector)
+}
+
+//正则匹配解码后的内容，返回第一个匹配和分组，没有匹配时返回nil
+func (r *Response) Submatch(pattern string) ([]string, error) {
+	re, text, err := r.regexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.FindStringSubmatch(text), nil
+}
+
+//正则匹配解码后的内容，返回所有匹配和分组
+func (r *Response) AllSubmatch(pattern string) ([][]string, error) {
+	re, text, err := r.regexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.FindAllStringSubmatch(text, -1), nil
+}
+
+func (r *Response) regexp(pattern string) (*regexp.Regexp, string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	text, err := r.DecodedText()
+	return re, text, err
+}
+
+//使用XPath查询HTML，返回匹配的节点的字符串值
+//元素返回其中所有的文本，属性返回属性值
+//支持XPath的常用子集：/、//、*、.、..、@attr、text()
+//谓词支持序号、last()、[@attr]、[@attr='v']、[text()='v']、[contains(@attr,'v')]、[starts-with(.,'v')]、!=
+//eg: //form[@id='login']//input[@name='token']/@value
+func (r *Response) XPath(expr string) ([]string, error) {
+	steps, err := parseXPath(expr)
+	if err != nil {
+		return nil, err
+	}
+	text, err := r.DecodedText()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	nodes := []xnode{{n: doc}}
+	for _, step := range steps {
+		nodes = step.apply(nodes)
+	}
+	values := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		values = append(values, node.value())
+	}
+	return values, nil
+}
+
+//XPath匹配的节点，attr不为nil时是元素n的属性
+type xnode struct {
+	n    *html.Node
+	attr *html.Attribute
+}
+
+func (x xnode) value() string {
+	if x.attr != nil {
+		return x.attr.Val
+	}
+	return nodeText(x.n)
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				b.WriteString(c.Data)
+			} else {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+const (
+	xElement = iota
+	xAttr
+	xText
+	xSelf
+	xParent
+)
+
+type xstep struct {
+	//前面是//
+	descendant bool
+	kind       int
+	//元素或者属性名，*匹配所有
+	name  string
+	preds []xpred
+}
+
+type xpred struct {
+	//大于0时是序号，-1是last()
+	index int
+	//=、!=、contains、starts-with，为空时判断是否存在
+	op     string
+	target string
+	value  string
+}
+
+func parseXPath(expr string) ([]xstep, error) {
+	var steps []xstep
+	s := strings.TrimSpace(expr)
+	if s == "" {
+		return nil, fmt.Errorf("requests: empty xpath")
+	}
+	for s != "" {
+		var step xstep
+		switch {
+		case strings.HasPrefix(s, "//"):
+			step.descendant = true
+			s = s[2:]
+		case strings.HasPrefix(s, "/"):
+			s = s[1:]
+		case len(steps) > 0:
+			return nil, fmt.Errorf("requests: bad xpath %q", expr)
+		}
+
+		end := 0
+		for end < len(s) && s[end] != '/' && s[end] != '[' {
+			end++
+		}
+		test := strings.TrimSpace(s[:end])
+		s = s[end:]
+		switch {
+		case test == "":
+			return nil, fmt.Errorf("requests: bad xpath %q", expr)
+		case test == ".":
+			step.kind = xSelf
+		case test == "..":
+			step.kind = xParent
+		case test == "text()":
+			step.kind = xText
+		case strings.HasPrefix(test, "@"):
+			step.kind, step.name = xAttr, strings.ToLower(test[1:])
+		default:
+			step.kind, step.name = xElement, strings.ToLower(test)
+		}
+
+		for strings.HasPrefix(s, "[") {
+			end, err := closingBracket(s)
+			if err != nil {
+				return nil, fmt.Errorf("requests: bad xpath %q: %v", expr, err)
+			}
+			pred, err := parsePredicate(strings.TrimSpace(s[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("requests: bad xpath %q: %v", expr, err)
+			}
+			step.preds = append(step.preds, pred)
+			s = s[end+1:]
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+//跳过引号中的内容，返回匹配的]的位置
+func closingBracket(s string) (int, error) {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ']':
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unclosed [")
+}
+
+func parsePredicate(s string) (xpred, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return xpred{}, fmt.Errorf("bad position %d", n)
+		}
+		return xpred{index: n}, nil
+	}
+	if s == "last()" {
+		return xpred{index: -1}, nil
+	}
+	for _, fn := range []string{"contains", "starts-with"} {
+		if !strings.HasPrefix(s, fn+"(") || !strings.HasSuffix(s, ")") {
+			continue
+		}
+		args := strings.SplitN(s[len(fn)+1:len(s)-1], ",", 2)
+		if len(args) != 2 {
+			return xpred{}, fmt.Errorf("%s needs two arguments", fn)
+		}
+		value, err := unquote(args[1])
+		if err != nil {
+			return xpred{}, err
+		}
+		return xpred{op: fn, target: strings.TrimSpace(args[0]), value: value}, nil
+	}
+	//引号外的第一个=
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '=' && i > 0:
+			op, target := "=", s[:i]
+			if strings.HasSuffix(target, "!") {
+				op, target = "!=", target[:len(target)-1]
+			}
+			value, err := unquote(s[i+1:])
+			if err != nil {
+				return xpred{}, err
+			}
+			return xpred{op: op, target: strings.TrimSpace(target), value: value}, nil
+		}
+	}
+	return xpred{target: s}, nil
+}
+
+func unquote(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", fmt.Errorf("expected a quoted string, got %q", s)
+	}
+	return s[1 : len(s)-1], nil
+}
+
+//对每个上下文节点，在子节点(//时是所有后代的子节点)中按父节点分组匹配，谓词的序号在组内计算
+func (step xstep) apply(contexts []xnode) []xnode {
+	var result []xnode
+	seen := make(map[xnode]bool)
+	add := func(group []xnode) {
+		for i, node := range group {
+			if step.match(node, i+1, len(group)) && !seen[node] {
+				seen[node] = true
+				result = append(result, node)
+			}
+		}
+	}
+	for _, ctx := range contexts {
+		if ctx.attr != nil {
+			continue
+		}
+		switch step.kind {
+		case xSelf:
+			add([]xnode{ctx})
+			continue
+		case xParent:
+			if ctx.n.Parent != nil {
+				add([]xnode{{n: ctx.n.Parent}})
+			}
+			continue
+		}
+		parents := []*html.Node{ctx.n}
+		if step.descendant {
+			parents = descendantsOrSelf(ctx.n)
+		}
+		for _, parent := range parents {
+			add(step.candidates(parent))
+		}
+	}
+	return result
+}
+
+func descendantsOrSelf(n *html.Node) []*html.Node {
+	nodes := []*html.Node{n}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		nodes = append(nodes, descendantsOrSelf(c)...)
+	}
+	return nodes
+}
+
+func (step xstep) candidates(parent *html.Node) []xnode {
+	var group []xnode
+	if step.kind == xAttr {
+		if parent.Type != html.ElementNode {
+			return nil
+		}
+		for i := range parent.Attr {
+			if step.name == "*" || parent.Attr[i].Key == step.name {
+				group = append(group, xnode{n: parent, attr: &parent.Attr[i]})
+			}
+		}
+		return group
+	}
+	for c := parent.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case step.kind == xText && c.Type == html.TextNode,
+			step.kind == xElement && c.Type == html.ElementNode && (step.name == "*" || c.Data == step.name):
+			group = append(group, xnode{n: c})
+		}
+	}
+	return group
+}
+
+func (step xstep) match(node xnode, position, size int) bool {
+	for _, pred := range step.preds {
+		switch {
+		case pred.index > 0:
+			if position != pred.index {
+				return false
+			}
+		case pred.index < 0:
+			if position != size {
+				return false
+			}
+		default:
+			if !pred.match(node) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (pred xpred) match(node xnode) bool {
+	values := targetValues(node, pred.target)
+	if pred.op == "" {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		switch pred.op {
+		case "=":
+			if v == pred.value {
+				return true
+			}
+		case "!=":
+			if v != pred.value {
+				return true
+			}
+		case "contains":
+			if strings.Contains(v, pred.value) {
+				return true
+			}
+		case "starts-with":
+			if strings.HasPrefix(v, pred.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//谓词中比较的值，target可以是.、text()、@attr或者子元素名
+func targetValues(node xnode, target string) []string {
+	switch {
+	case target == ".":
+		return []string{node.value()}
+	case node.attr != nil:
+		return nil
+	case target == "text()":
+		var values []string
+		for c := node.n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				values = append(values, c.Data)
+			}
+		}
+		return values
+	case strings.HasPrefix(target, "@"):
+		name := strings.ToLower(target[1:])
+		for _, a := range node.n.Attr {
+			if a.Key == name {
+				return []string{a.Val}
+			}
+		}
+		return nil
+	}
+	var values []string
+	name := strings.ToLower(target)
+	for c := node.n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (name == "*" || c.Data == name) {
+			values = append(values, nodeText(c))
+		}
+	}
+	return values
+}
+
+//使用JSONPath查询json内容，返回所有匹配的值，数字是json.Number
+//支持$、.key、['key']、[n]、[-n]、[*]、.*、..key(递归查找)
+//eg: $.data.items[0].token、$..version
+func (r *Response) JSONPath(path string) ([]interface{}, error) {
+	if r.empty() {
+		return nil, ErrNoResponse
+	}
+	tokens, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(r.body))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+	values := []interface{}{root}
+	for _, token := range tokens {
+		values = token.apply(values)
+	}
+	return values, nil
+}
+
+type jsonToken struct {
+	recursive bool
+	//*，匹配所有子节点
+	wildcard bool
+	key      string
+	index    *int
+}
+
+func parseJSONPath(path string) ([]jsonToken, error) {
+	s := strings.TrimSpace(path)
+	s = strings.TrimPrefix(s, "$")
+	var tokens []jsonToken
+	bad := func() ([]jsonToken, error) {
+		return nil, fmt.Errorf("requests: bad jsonpath %q", path)
+	}
+	for s != "" {
+		var token jsonToken
+		switch {
+		case strings.HasPrefix(s, ".."):
+			token.recursive = true
+			s = s[2:]
+		case strings.HasPrefix(s, "."):
+			s = s[1:]
+		case strings.HasPrefix(s, "["):
+		default:
+			return bad()
+		}
+
+		if strings.HasPrefix(s, "[") {
+			end, err := closingBracket(s)
+			if err != nil {
+				return bad()
+			}
+			inner := strings.TrimSpace(s[1:end])
+			s = s[end+1:]
+			switch {
+			case inner == "*":
+				token.wildcard = true
+			case strings.HasPrefix(inner, "'") || strings.HasPrefix(inner, `"`):
+				key, err := unquote(inner)
+				if err != nil {
+					return bad()
+				}
+				token.key = key
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return bad()
+				}
+				token.index = &n
+			}
+		} else {
+			end := 0
+			for end < len(s) && s[end] != '.' && s[end] != '[' {
+				end++
+			}
+			if end == 0 {
+				return bad()
+			}
+			if key := s[:end]; key == "*" {
+				token.wildcard = true
+			} else {
+				token.key = key
+			}
+			s = s[end:]
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (token jsonToken) apply(values []interface{}) []interface{} {
+	var result []interface{}
+	for _, v := range values {
+		if token.recursive {
+			for _, d := range jsonDescendants(v) {
+				result = append(result, token.children(d)...)
+			}
+		} else {
+			result = append(result, token.children(v)...)
+		}
+	}
+	return result
+}
+
+func (token jsonToken) children(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if token.index != nil {
+			return nil
+		}
+		if !token.wildcard {
+			if child, ok := v[token.key]; ok {
+				return []interface{}{child}
+			}
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		children := make([]interface{}, 0, len(v))
+		for _, k := range keys {
+			children = append(children, v[k])
+		}
+		return children
+	case []interface{}:
+		if token.index != nil {
+			i := *token.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return []interface{}{v[i]}
+		}
+		if token.wildcard {
+			return v
+		}
+	}
+	return nil
+}
+
+//v和v中所有的对象和数组，对象按key排序
+func jsonDescendants(v interface{}) []interface{} {
+	result := []interface{}{v}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result = append(result, jsonDescendants(v[k])...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			result = append(result, jsonDescendants(child)...)
+		}
+	}
+	return result
+}
@@ -0,0 +1,350 @@
+package requests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rawKey struct{}
+
+//请求中原样发送的内容，不是raw请求时返回false
+func rawPayload(ctx context.Context) ([]byte, bool) {
+	raw, ok := ctx.Value(rawKey{}).([]byte)
+	return raw, ok
+}
+
+func withRaw(raw []byte) DialOption {
+	return func(opts *dialOptions) {
+		opts.raw = raw
+	}
+}
+
+//原样发送raw中的请求，不做任何检查和修改，可以发送不符合RFC的请求
+//target是目标地址，eg: https://127.0.0.1:8443，决定连接的地址和是否使用TLS
+//raw请求同样经过中间件，使用client的transport中的代理、拨号和TLS配置，不会跟随跳转
+func Raw(ctx context.Context, target string, raw []byte, opts ...DialOption) (*Response, error) {
+	return defaultReq.Raw(ctx, target, raw, opts...)
+}
+
+func (req *Client) Raw(ctx context.Context, target string, raw []byte, opts ...DialOption) (*Response, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("requests: unsupported raw target %q", target)
+	}
+
+	//中间件和返回的Response看到的请求，由请求行生成
+	//连接的始终是target，请求行中的绝对地址只取路径
+	method, uri := requestLine(raw)
+	u := *base
+	u.RawQuery = ""
+	if ref, err := url.Parse(uri); err == nil && uri != "" && uri != "*" {
+		u.Path, u.RawPath, u.RawQuery = ref.Path, ref.RawPath, ref.RawQuery
+	}
+	if _, err := http.NewRequest(method, u.String(), nil); err != nil {
+		method = http.MethodGet
+	}
+
+	opts = append(opts[:len(opts):len(opts)], withRaw(raw))
+	return req.do(ctx, method, u.String(), opts...)
+}
+
+//返回请求行中的方法和uri，无法解析时返回空
+func requestLine(raw []byte) (string, string) {
+	line := raw
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return "", ""
+	}
+	return fields[0], fields[1]
+}
+
+//连接raw请求的目标，然后原样发送请求
+func sendRaw(client *http.Client, request *http.Request, raw []byte) (*http.Response, error) {
+	var transport *http.Transport
+	switch rt := client.Transport.(type) {
+	case nil:
+		transport, _ = http.DefaultTransport.(*http.Transport)
+	case *http.Transport:
+		transport = rt
+	case *HARReplay:
+		//回放时按请求中的body匹配
+		return rt.RoundTrip(request)
+	default:
+		//无法知道自定义的transport如何连接，不能绕过它直连
+		return nil, fmt.Errorf("requests: raw requests need an *http.Transport, got %T", rt)
+	}
+
+	ctx := request.Context()
+	var deadline time.Time
+	if client.Timeout > 0 {
+		deadline = time.Now().Add(client.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	trace := httptrace.ContextClientTrace(request.Context())
+	if trace != nil && trace.GetConn != nil {
+		trace.GetConn(request.URL.Host)
+	}
+	conn, state, err := dialRaw(ctx, transport, request)
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+	//连接在body关闭时关闭
+	done := make(chan struct{})
+	var once sync.Once
+	closeConn := func() error {
+		var err error
+		once.Do(func() {
+			close(done)
+			err = conn.Close()
+		})
+		return err
+	}
+	go func() {
+		select {
+		case <-request.Context().Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	if !deadline.IsZero() {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(raw); err != nil {
+		_ = closeConn()
+		return nil, err
+	}
+
+	resp, err := readRawResponse(conn, request)
+	if err != nil {
+		_ = closeConn()
+		return nil, err
+	}
+	resp.TLS = state
+	resp.Body = &rawBody{ReadCloser: resp.Body, close: closeConn}
+	return resp, nil
+}
+
+//连接目标，目标是https时同时返回TLS连接信息
+func dialRaw(ctx context.Context, transport *http.Transport, request *http.Request) (net.Conn, *tls.ConnectionState, error) {
+	dial := (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	var tlsConfig *tls.Config
+	var proxy *url.URL
+	if transport != nil {
+		if transport.DialContext != nil {
+			dial = transport.DialContext
+		}
+		tlsConfig = transport.TLSClientConfig
+		if transport.Proxy != nil {
+			var err error
+			if proxy, err = transport.Proxy(request); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	address := hostPort(request.URL)
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = connectProxy(ctx, dial, tlsConfig, proxy, address)
+	} else {
+		conn, err = dial(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if request.URL.Scheme == "https" {
+		tlsConn := tls.Client(conn, serverTLSConfig(tlsConfig, request.URL.Hostname()))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+		state := tlsConn.ConnectionState()
+		return tlsConn, &state, nil
+	}
+	return conn, nil, nil
+}
+
+//通过http代理的CONNECT建立到address的隧道
+//raw请求的请求行不是代理需要的格式，所以http目标也使用隧道
+func connectProxy(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error),
+	tlsConfig *tls.Config, proxy *url.URL, address string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", proxyAddress(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, serverTLSConfig(tlsConfig, proxy.Hostname()))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		fmt.Fprintf(&b, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	//逐字节读取代理响应的header，不会多读隧道中的数据
+	//响应的body就是隧道，不能读取或关闭
+	resp, err := http.ReadResponse(bufio.NewReaderSize(&byteReader{conn}, 16), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("requests: proxy %s refused CONNECT: %s", proxy.Redacted(), resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func serverTLSConfig(config *tls.Config, serverName string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	return config
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+//解析目标返回的内容
+//不是HTTP响应时，返回StatusCode为0的Response，收到的所有内容都在Body中
+func readRawResponse(conn net.Conn, request *http.Request) (*http.Response, error) {
+	rec := &recorder{r: conn}
+	if trace := httptrace.ContextClientTrace(request.Context()); trace != nil {
+		rec.firstByte = trace.GotFirstResponseByte
+	}
+	br := bufio.NewReader(rec)
+	for {
+		resp, err := http.ReadResponse(br, request)
+		if err != nil {
+			if rec.buf.Len() == 0 {
+				return nil, err
+			}
+			return &http.Response{
+				Proto:         "HTTP/0.9",
+				ProtoMinor:    9,
+				Header:        make(http.Header),
+				Body:          io.NopCloser(io.MultiReader(bytes.NewReader(rec.buf.Bytes()), conn)),
+				ContentLength: -1,
+				Close:         true,
+				Request:       request,
+			}, nil
+		}
+		//跳过100 Continue之类的中间响应
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			_ = resp.Body.Close()
+			continue
+		}
+		rec.stop = true
+		rec.buf = bytes.Buffer{}
+		return resp, nil
+	}
+}
+
+//记录读到的内容，响应解析失败时作为body返回
+type recorder struct {
+	r    io.Reader
+	buf  bytes.Buffer
+	stop bool
+	//收到第一个字节时调用
+	firstByte func()
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && r.firstByte != nil {
+		r.firstByte()
+		r.firstByte = nil
+	}
+	if !r.stop {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+//每次只读一个字节，避免bufio多读
+type byteReader struct {
+	r io.Reader
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+type rawBody struct {
+	io.ReadCloser
+	close func() error
+}
+
+func (b *rawBody) Close() error {
+	err := b.ReadCloser.Close()
+	if cerr := b.close(); err == nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
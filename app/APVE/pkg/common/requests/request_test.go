@@ -1,12 +1,35 @@
 package requests
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/axgle/mahonia"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -170,3 +193,2101 @@ func TestRequest_File(t *testing.T) {
 		log.Fatal(err)
 	}
 }
+
+type echo struct {
+	Id     string
+	Header string
+	Base   string
+	Cookie string
+	Body   string
+}
+
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "secret"})
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var cookies []string
+		for _, c := range r.Cookies() {
+			cookies = append(cookies, c.Name+"="+c.Value)
+		}
+		_ = json.NewEncoder(w).Encode(echo{
+			Id:     r.URL.Query().Get("id"),
+			Header: r.Header.Get("X-Id"),
+			Base:   r.Header.Get("X-Base"),
+			Cookie: strings.Join(cookies, ";"),
+			Body:   string(body),
+		})
+	}))
+}
+
+func TestClient_Concurrent(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+
+	var calls int64
+	counter := func(next Handler) Handler {
+		return func(client *http.Client, request *http.Request) (*http.Response, error) {
+			atomic.AddInt64(&calls, 1)
+			return next(client, request)
+		}
+	}
+	client := New(
+		WithHeaders(Value{"X-Base": "base"}),
+		WithMiddleware(counter),
+		WithRetry(),
+		WithJSON(map[string]string{"from": "base"}),
+	)
+
+	const workers, requests = 16, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				id := strconv.Itoa(w*requests + i)
+				opts := []DialOption{
+					WithParam(Value{"id": id}),
+					WithHeaders(Value{"X-Id": id}),
+					WithCookies(&http.Cookie{Name: "id", Value: id}),
+				}
+				body := `{"from":"base"}`
+				if i%2 == 0 {
+					body = "id=" + id
+					opts = append(opts, WithForm(Value{"id": id}))
+				}
+				resp, err := client.Post(context.Background(), srv.URL, opts...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var got echo
+				if err := resp.JSON(&got); err != nil {
+					t.Error(err)
+					return
+				}
+				want := echo{Id: id, Header: id, Base: "base", Cookie: "id=" + id, Body: body}
+				if got != want {
+					t.Errorf("got %+v, want %+v", got, want)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if calls != workers*requests {
+		t.Errorf("middleware called %d times, want %d", calls, workers*requests)
+	}
+	if len(client.opts.middles) != 2 || len(client.opts.headers) != 1 || client.opts.headers["Content-Type"] != "application/json" || client.opts.query != "" {
+		t.Errorf("base options changed by requests: %+v", client.opts)
+	}
+}
+
+func TestClient_Session(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+
+	me := func(client *Client) string {
+		resp, err := client.Get(context.Background(), srv.URL+"/me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got echo
+		if err := resp.JSON(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Cookie
+	}
+
+	session := Session()
+	if _, err := session.Get(context.Background(), srv.URL+"/login"); err != nil {
+		t.Fatal(err)
+	}
+	if got := me(session); got != "token=secret" {
+		t.Errorf("session cookie = %q, want token=secret", got)
+	}
+
+	if _, err := Get(context.Background(), srv.URL+"/login", WithSession(true)); err != nil {
+		t.Fatal(err)
+	}
+	if got := me(defaultReq); got != "" {
+		t.Errorf("default client kept cookie %q", got)
+	}
+	if http.DefaultClient.Jar != nil {
+		t.Error("http.DefaultClient.Jar was set")
+	}
+	if _, err := session.Get(context.Background(), srv.URL+"/me", WithSession(false)); err != nil {
+		t.Fatal(err)
+	}
+	if session.opts.client.Jar == nil {
+		t.Error("request without session cleared the session jar")
+	}
+}
+
+//记录收到的请求的http代理，不转发请求
+func newHTTPProxy(name string) (*httptest.Server, *int64) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		_, _ = fmt.Fprintf(w, "%s %s %s", name, r.URL.Host, r.Header.Get("Proxy-Authorization"))
+	}))
+	return srv, &hits
+}
+
+//只支持CONNECT和用户名密码认证的socks5代理
+func newSocks5Proxy(t *testing.T, user, pass string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(conn net.Conn) error {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte{5, 2}); err != nil {
+			return err
+		}
+		//RFC 1929
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		u := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, u); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		p := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, p); err != nil {
+			return err
+		}
+		if string(u) != user || string(p) != pass {
+			_, _ = conn.Write([]byte{1, 1})
+			return errors.New("bad credentials")
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return err
+		}
+		var host string
+		switch buf[3] {
+		case 1:
+			if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+				return err
+			}
+			host = net.IP(buf[:4]).String()
+		case 3:
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return err
+			}
+			name := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, name); err != nil {
+				return err
+			}
+			host = string(name)
+		default:
+			return errors.New("unsupported address type")
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		port := int(buf[0])<<8 | int(buf[1])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		defer target.Close()
+		if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return err
+		}
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, err = io.Copy(conn, target)
+		return err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = serve(conn) }()
+		}
+	}()
+	return ln
+}
+
+func TestClient_Proxy(t *testing.T) {
+	p1, _ := newHTTPProxy("p1")
+	defer p1.Close()
+	p2, _ := newHTTPProxy("p2")
+	defer p2.Close()
+
+	text := func(client *Client, opts ...DialOption) string {
+		resp, err := client.Get(context.Background(), "http://target.test/", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := resp.Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	u, _ := url.Parse(p1.URL)
+	u.User = url.UserPassword("user", "pass")
+	client := New(WithProxy(u.String()))
+	if got, want := text(client), "p1 target.test Basic dXNlcjpwYXNz"; got != want {
+		t.Errorf("base proxy: got %q, want %q", got, want)
+	}
+	if got, want := text(client, WithProxy(p2.URL)), "p2 target.test "; got != want {
+		t.Errorf("request proxy: got %q, want %q", got, want)
+	}
+	if got, want := text(client), "p1 target.test Basic dXNlcjpwYXNz"; got != want {
+		t.Errorf("base proxy after request proxy: got %q, want %q", got, want)
+	}
+
+	srv := newEchoServer()
+	defer srv.Close()
+	socks := newSocks5Proxy(t, "user", "pass")
+	defer socks.Close()
+	resp, err := Get(context.Background(), srv.URL, WithParam(Value{"id": "1"}),
+		WithProxy("socks5://user:pass@"+socks.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got echo
+	if err := resp.JSON(&got); err != nil || got.Id != "1" {
+		t.Errorf("socks5 proxy: got %+v, %v", got, err)
+	}
+	if _, err := Get(context.Background(), srv.URL, WithProxy("socks5://user:wrong@"+socks.Addr().String())); err == nil {
+		t.Error("socks5 proxy with wrong password: no error")
+	}
+
+	//连接socks5代理使用client的transport的DialContext
+	var dials int64
+	transport := NewTransport(TransportConfig{})
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == socks.Addr().String() {
+			atomic.AddInt64(&dials, 1)
+		}
+		return dial(ctx, network, address)
+	}
+	_, err = Get(context.Background(), srv.URL, WithClient(&http.Client{Transport: transport}),
+		WithProxy("socks5://user:pass@"+socks.Addr().String()))
+	if err != nil || atomic.LoadInt64(&dials) != 1 {
+		t.Errorf("socks5 forward dialer: %d dials, %v", atomic.LoadInt64(&dials), err)
+	}
+
+	for _, proxy := range []string{"ftp://127.0.0.1:21", "http://", "::"} {
+		if _, err := Get(context.Background(), srv.URL, WithProxy(proxy)); err == nil {
+			t.Errorf("WithProxy(%q): no error", proxy)
+		}
+	}
+}
+
+func TestProxyPool(t *testing.T) {
+	p1, hits1 := newHTTPProxy("p1")
+	defer p1.Close()
+	p2, hits2 := newHTTPProxy("p2")
+	defer p2.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	pool, err := NewProxyPool(p1.URL, p2.URL, dead.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.MaxFails = 2
+	client := New(WithMiddleware(pool.Middleware()))
+
+	failed := 0
+	for i := 0; i < 30; i++ {
+		resp, err := client.Get(context.Background(), "http://target.test/")
+		if err != nil {
+			failed++
+			continue
+		}
+		_ = resp.Close()
+	}
+	if failed != 2 {
+		t.Errorf("%d requests failed, want 2 before the dead proxy is taken out", failed)
+	}
+	if *hits1 == 0 || *hits2 == 0 {
+		t.Errorf("requests not rotated: p1 %d, p2 %d", *hits1, *hits2)
+	}
+	if alive := pool.Alive(); len(alive) != 2 {
+		t.Errorf("alive = %v, want the two live proxies", alive)
+	}
+
+	p2.Close()
+	pool.CheckURL = "http://target.test/"
+	pool.Check(context.Background())
+	if alive := pool.Alive(); len(alive) != 1 || alive[0] != p1.URL {
+		t.Errorf("alive after check = %v, want [%s]", alive, p1.URL)
+	}
+
+	p1.Close()
+	pool.Check(context.Background())
+	if _, err := client.Get(context.Background(), "http://target.test/"); err != ErrNoProxy {
+		t.Errorf("empty pool: err = %v, want ErrNoProxy", err)
+	}
+}
+
+//并发计数，记录最大值
+type gauge struct {
+	n, peak int64
+}
+
+func (g *gauge) inc() {
+	n := atomic.AddInt64(&g.n, 1)
+	for {
+		p := atomic.LoadInt64(&g.peak)
+		if n <= p || atomic.CompareAndSwapInt64(&g.peak, p, n) {
+			return
+		}
+	}
+}
+
+func (g *gauge) dec() {
+	atomic.AddInt64(&g.n, -1)
+}
+
+//每个请求阻塞delay，记录服务和所有服务的并发数
+func newSlowServer(delay time.Duration, host, total *gauge) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.inc()
+		total.inc()
+		time.Sleep(delay)
+		total.dec()
+		host.dec()
+	}))
+}
+
+func TestLimiter_InFlight(t *testing.T) {
+	var g1, g2, total gauge
+	s1 := newSlowServer(20*time.Millisecond, &g1, &total)
+	defer s1.Close()
+	s2 := newSlowServer(20*time.Millisecond, &g2, &total)
+	defer s2.Close()
+
+	limiter := NewLimiter(Limit{MaxInFlight: 3}, Limit{MaxInFlight: 2})
+	//两个client共用一个limiter
+	clients := []*Client{New(WithLimiter(limiter)), New(WithLimiter(limiter))}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 24; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := s1.URL
+			if i%2 == 1 {
+				target = s2.URL
+			}
+			resp, err := clients[i/2%len(clients)].Get(context.Background(), target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = resp.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	if g1.peak > 2 || g2.peak > 2 {
+		t.Errorf("per host peak = %d, %d, want at most 2", g1.peak, g2.peak)
+	}
+	if total.peak > 3 || total.peak < 2 {
+		t.Errorf("global peak = %d, want 2 or 3", total.peak)
+	}
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	client := New(WithLimiter(NewLimiter(Limit{}, Limit{Rate: 20, Burst: 2})))
+	get := func(target string) {
+		resp, err := client.Get(context.Background(), target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Close()
+	}
+
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		get(srv.URL)
+	}
+	//burst 2个，之后每50ms一个
+	if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+		t.Errorf("7 requests at 20/s took %v", elapsed)
+	}
+	start = time.Now()
+	get(other.URL)
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("other host waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	get(srv.URL)
+	if _, err := client.Get(ctx, srv.URL); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestLimiter_Backoff(t *testing.T) {
+	var hits int64
+	var second time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		second = time.Now()
+	}))
+	defer srv.Close()
+
+	client := New(WithLimiter(NewLimiter(Limit{}, Limit{})))
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Close()
+	}
+	if wait := second.Sub(start); wait < 900*time.Millisecond {
+		t.Errorf("request after 429 sent after %v, want Retry-After of 1s", wait)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := &bucket{rate: 10, burst: 2, tokens: 2, last: now}
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if got := b.reserve(now); got != want {
+			t.Errorf("reserve %d = %v, want %v", i, got, want)
+		}
+	}
+	b.cancel()
+	if got := b.reserve(now); got != 200*time.Millisecond {
+		t.Errorf("reserve after cancel = %v, want 200ms", got)
+	}
+
+	b = &bucket{rate: 10, burst: 1, tokens: 1, last: now, paused: now.Add(time.Second)}
+	for i, want := range []time.Duration{time.Second, 1100 * time.Millisecond} {
+		if got := b.reserve(now); got != want {
+			t.Errorf("paused reserve %d = %v, want %v", i, got, want)
+		}
+	}
+	if b.idle(now.Add(time.Second)) || !b.idle(now.Add(2*time.Second)) {
+		t.Error("idle bucket")
+	}
+}
+
+//保存收到的原始内容，回复reply后关闭连接
+func newRawServer(t *testing.T, reply string) (net.Listener, chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var buf []byte
+			chunk := make([]byte, 1024)
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, err := conn.Read(chunk)
+				buf = append(buf, chunk[:n]...)
+				if err != nil {
+					break
+				}
+			}
+			received <- buf
+			_, _ = io.WriteString(conn, reply)
+			_ = conn.Close()
+		}
+	}()
+	return ln, received
+}
+
+func TestRaw(t *testing.T) {
+	ln, received := newRawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nX-Dup: 1\r\nX-Dup: 2\r\n\r\nok")
+	defer ln.Close()
+
+	//重复的header、错误的Content-Length、只有LF的换行
+	raw := "POST /cgi-bin/a.cgi?x=1 HTTP/1.1\nHost: evil\nX: 1\nX: 2\nContent-Length: 999\n\nuser=a|id"
+	resp, err := Raw(context.Background(), "http://"+ln.Addr().String(), []byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(<-received); got != raw {
+		t.Errorf("sent %q, want %q", got, raw)
+	}
+	r := resp.Response()
+	if r.StatusCode != 200 || len(r.Header["X-Dup"]) != 2 {
+		t.Errorf("response %d %v", r.StatusCode, r.Header)
+	}
+	if r.Request.Method != "POST" || r.Request.URL.Path != "/cgi-bin/a.cgi" || r.Request.URL.RawQuery != "x=1" {
+		t.Errorf("request %s %s", r.Request.Method, r.Request.URL)
+	}
+	if text, err := resp.Text(); err != nil || text != "ok" {
+		t.Errorf("body %q, %v", text, err)
+	}
+
+	//不是HTTP的响应原样返回
+	banner, _ := newRawServer(t, "SSH-2.0-OpenSSH_8.0\r\n")
+	defer banner.Close()
+	resp, err = Raw(context.Background(), "http://"+banner.Addr().String(), []byte("GARBAGE\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response().StatusCode != 0 {
+		t.Errorf("status %d, want 0", resp.Response().StatusCode)
+	}
+	if text, _ := resp.Text(); text != "SSH-2.0-OpenSSH_8.0\r\n" {
+		t.Errorf("body %q", text)
+	}
+
+	if _, err := Raw(context.Background(), "ftp://"+ln.Addr().String(), []byte(raw)); err == nil {
+		t.Error("ftp target: no error")
+	}
+}
+
+func TestRaw_TLSProxy(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("X-Test"))
+	}))
+	defer srv.Close()
+
+	var tunnels int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		atomic.AddInt64(&tunnels, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, _ = io.Copy(conn, target)
+	}))
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("user", "pass")
+	client := New(WithClient(srv.Client()))
+	raw := []byte("GET /tls HTTP/1.1\r\nHost: example\r\nX-Test: raw\r\nConnection: close\r\n\r\n")
+	for _, opts := range [][]DialOption{nil, {WithProxy(u.String())}} {
+		resp, err := client.Raw(context.Background(), srv.URL, raw, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text, err := resp.Text(); err != nil || text != "/tls raw" {
+			t.Errorf("body %q, %v", text, err)
+		}
+	}
+	if tunnels != 1 {
+		t.Errorf("%d tunnels through the proxy, want 1", tunnels)
+	}
+
+	u.User = url.UserPassword("user", "wrong")
+	if _, err := client.Raw(context.Background(), srv.URL, raw, WithProxy(u.String())); err == nil {
+		t.Error("wrong proxy password: no error")
+	}
+}
+
+func TestResponse_Replay(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "1")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	client := New(WithClient(srv.Client()))
+
+	resp, err := client.Get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//可以多次、同时读取
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if text, err := resp.Text(); err != nil || text != body {
+				t.Errorf("Text() = %d bytes, %v", len(text), err)
+			}
+			var buf []byte
+			for chunk := range resp.Raw() {
+				buf = append(buf, chunk...)
+			}
+			if string(buf) != body {
+				t.Errorf("Raw() = %d bytes", len(buf))
+			}
+			if b, _ := ioutil.ReadAll(resp.Response().Body); string(b) != body {
+				t.Errorf("Response().Body = %d bytes", len(b))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if resp.StatusCode() != http.StatusTeapot || resp.Status() != "418 I'm a teapot" || resp.Header().Get("X-Test") != "1" {
+		t.Errorf("status %q, header %v", resp.Status(), resp.Header())
+	}
+	if resp.TLS() == nil || resp.RemoteAddr() != srv.Listener.Addr().String() {
+		t.Errorf("TLS %v, remote %q", resp.TLS(), resp.RemoteAddr())
+	}
+	timing := resp.Timing()
+	if timing.TLS <= 0 || timing.FirstByte <= 0 || timing.Total < timing.FirstByte || resp.Elapsed() != timing.Total {
+		t.Errorf("timing %+v", timing)
+	}
+	dump, err := resp.Dump()
+	if err != nil || !bytes.HasPrefix(dump, []byte("HTTP/1.1 418 I'm a teapot\r\nContent-Length: 10000\r\n")) ||
+		!bytes.HasSuffix(dump, []byte("\r\n\r\n"+body)) {
+		t.Errorf("dump %.100q, %v", dump, err)
+	}
+	if resp.Truncated() {
+		t.Error("truncated")
+	}
+
+	resp, err = client.Get(context.Background(), srv.URL, WithMaxSize(15))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != body[:15] || !resp.Truncated() {
+		t.Errorf("MaxSize 15: %q, truncated %v", text, resp.Truncated())
+	}
+
+	//请求失败时的Response也可以使用
+	resp, err = client.Get(context.Background(), "http://127.0.0.1:0/")
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if text, err := resp.Text(); text != "" || err != ErrNoResponse || resp.StatusCode() != 0 {
+		t.Errorf("failed request: %q, %v", text, err)
+	}
+	var none *Response
+	if _, err := none.Content(); err != ErrNoResponse || none.Elapsed() != 0 {
+		t.Errorf("nil response: %v", err)
+	}
+}
+
+func TestRaw_Response(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "raw")
+	}))
+	defer srv.Close()
+
+	resp, err := New(WithClient(srv.Client())).Raw(context.Background(), srv.URL,
+		[]byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != "raw" {
+		t.Errorf("body %q", text)
+	}
+	if resp.TLS() == nil || resp.RemoteAddr() != srv.Listener.Addr().String() || resp.Timing().FirstByte <= 0 {
+		t.Errorf("TLS %v, remote %q, timing %+v", resp.TLS(), resp.RemoteAddr(), resp.Timing())
+	}
+}
+
+func TestRetry_Body(t *testing.T) {
+	var hits int64
+	var bodies []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if atomic.AddInt64(&hits, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	client := New(WithRetry(&RetryConfig{Wait: time.Millisecond}))
+	resp, err := client.Post(context.Background(), srv.URL, WithForm(Value{"a": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != "a=1" || resp.Retries() != 2 {
+		t.Errorf("body %q after %d retries, want a=1 after 2", text, resp.Retries())
+	}
+	if strings.Join(bodies, ",") != "a=1,a=1,a=1" {
+		t.Errorf("server got %q", bodies)
+	}
+
+	//body不能重新读取时不重试
+	bodies = nil
+	atomic.StoreInt64(&hits, 0)
+	resp, err = client.Post(context.Background(), srv.URL, WithBody(io.MultiReader(strings.NewReader("stream"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusServiceUnavailable || resp.Retries() != 0 || len(bodies) != 1 {
+		t.Errorf("stream body: status %d after %d retries, %d requests", resp.StatusCode(), resp.Retries(), len(bodies))
+	}
+
+	//设置为不重试
+	atomic.StoreInt64(&hits, 0)
+	resp, err = client.Get(context.Background(), srv.URL, WithRetry(&RetryConfig{MaxRetries: Retries(0)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusServiceUnavailable || resp.Retries() != 0 || atomic.LoadInt64(&hits) != 1 {
+		t.Errorf("MaxRetries 0: status %d after %d retries", resp.StatusCode(), resp.Retries())
+	}
+	atomic.StoreInt64(&hits, 0)
+	resp, err = client.Get(context.Background(), srv.URL, WithRetry(&RetryConfig{Wait: time.Millisecond, MaxRetries: Retries(1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusServiceUnavailable || resp.Retries() != 1 {
+		t.Errorf("MaxRetries 1: status %d after %d retries", resp.StatusCode(), resp.Retries())
+	}
+
+	//没有满足条件的不重试
+	atomic.StoreInt64(&hits, 0)
+	resp, err = client.Get(context.Background(), srv.URL, WithRetry(&RetryConfig{Conditions: []RetryCondition{RetryOnError}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusServiceUnavailable || resp.Retries() != 0 {
+		t.Errorf("RetryOnError: status %d after %d retries", resp.StatusCode(), resp.Retries())
+	}
+}
+
+//重试复用第一次的连接，各阶段记录的是最后一次
+func TestRetry_Timing(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewTransport(TransportConfig{})}
+	resp, err := Get(context.Background(), srv.URL, WithClient(client), WithRetry(&RetryConfig{Wait: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timing := resp.Timing()
+	if resp.Retries() != 1 || timing.Connect != 0 || timing.DNS != 0 || timing.FirstByte <= 0 ||
+		timing.FirstByte >= 100*time.Millisecond || timing.Total < 100*time.Millisecond {
+		t.Errorf("%d retries, timing %+v", resp.Retries(), timing)
+	}
+}
+
+func TestRetry_PolicyError(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	errPolicy := errors.New("no more retries")
+	policy := func(*http.Response, time.Duration, time.Duration, int) (time.Duration, error) {
+		return 0, errPolicy
+	}
+	_, err := Get(context.Background(), srv.URL, WithRetry(&RetryConfig{Policy: policy}))
+	if !errors.Is(err, errPolicy) || atomic.LoadInt64(&hits) != 1 {
+		t.Errorf("err %v after %d hits, want the policy error after 1", err, atomic.LoadInt64(&hits))
+	}
+}
+
+func TestRetry_RetryAfter(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := Get(context.Background(), srv.URL, WithRetry(&RetryConfig{Wait: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); resp.StatusCode() != 200 || resp.Retries() != 1 || elapsed < 900*time.Millisecond {
+		t.Errorf("status %d after %d retries in %v", resp.StatusCode(), resp.Retries(), elapsed)
+	}
+
+	//Retry-After超过最长等待时间时不重试，返回服务端的响应
+	long := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer long.Close()
+	start = time.Now()
+	resp, err = Get(context.Background(), long.URL, WithRetry(&RetryConfig{Wait: time.Millisecond, MaxWait: time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); resp.StatusCode() != http.StatusServiceUnavailable || resp.Retries() != 0 || elapsed > 500*time.Millisecond {
+		t.Errorf("long Retry-After: status %d after %d retries in %v", resp.StatusCode(), resp.Retries(), elapsed)
+	}
+
+	//等待时被取消
+	atomic.StoreInt64(&hits, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Get(ctx, srv.URL, WithRetry()); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestExponentialJitterBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			got, _ := ExponentialJitterBackoff(nil, 100*time.Millisecond, time.Second, attempt)
+			if got < want/2 || got > want {
+				t.Errorf("attempt %d: %v not in [%v, %v]", attempt, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestAuth_BasicBearer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	client := New(WithBasicAuth("user", "pass"), WithHeaders(Value{"Authorization": "ignored"}))
+	for _, tt := range []struct {
+		opts []DialOption
+		want string
+	}{
+		{nil, "Basic dXNlcjpwYXNz"},
+		{[]DialOption{WithBearer("token")}, "Bearer token"},
+		{[]DialOption{WithBasicAuth("a", "b")}, "Basic YTpi"},
+	} {
+		resp, err := client.Get(context.Background(), srv.URL, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := resp.Text(); got != tt.want {
+			t.Errorf("Authorization = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestDigestAuth_RFC7616(t *testing.T) {
+	//RFC 7616 3.9.1
+	d := &digestAuth{username: "Mufasa", password: "Circle of Life"}
+	for algorithm, want := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		c := &digestChallenge{
+			realm:     "http-auth@example.org",
+			nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			opaque:    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+			algorithm: algorithm,
+			qop:       "auth",
+		}
+		header := d.header(c, "GET", "/dir/index.html", "00000001", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", nil)
+		if !strings.Contains(header, `response="`+want+`"`) {
+			t.Errorf("%s: %s", algorithm, header)
+		}
+	}
+
+	c := parseDigestChallenge([]string{
+		`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=MD5, nonce="n1", opaque="o"`,
+		`Basic realm="b", Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="n2", opaque="o", userhash=true`,
+	})
+	want := &digestChallenge{realm: "http-auth@example.org", nonce: "n2", opaque: "o", algorithm: "SHA-256", qop: "auth", userhash: true}
+	if c == nil || *c != *want {
+		t.Errorf("challenge = %+v, want %+v", c, want)
+	}
+	if c := parseDigestChallenge([]string{`Basic realm="b"`, `Digest nonce="n", algorithm=SHA-1`}); c != nil {
+		t.Errorf("unsupported challenge = %+v", c)
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	var hits int64
+	server := &digestAuth{username: "admin", password: "secret"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		c := &digestChallenge{realm: "test", nonce: "abc", opaque: "xyz", algorithm: "SHA-256", qop: "auth-int"}
+		auth := parseChallenges(r.Header.Get("Authorization"))
+		if len(auth) == 1 && auth[0].scheme == "Digest" {
+			p := auth[0].params
+			want := server.header(c, r.Method, r.URL.RequestURI(), p["nc"], p["cnonce"], body)
+			if r.Header.Get("Authorization") == want {
+				_, _ = fmt.Fprintf(w, "%s %s", p["nc"], body)
+				return
+			}
+		}
+		w.Header().Add("WWW-Authenticate", `Digest realm="test", qop="auth-int", algorithm=SHA-256, nonce="abc", opaque="xyz"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	client := New(WithDigestAuth("admin", "secret"))
+	for i, want := range []string{"00000001 a=1", "00000002 a=1"} {
+		resp, err := client.Post(context.Background(), srv.URL+"/login?x=1", WithForm(Value{"a": "1"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := resp.Text(); got != want {
+			t.Errorf("request %d: %d %q, want %q", i, resp.StatusCode(), got, want)
+		}
+	}
+	//第二个请求复用了challenge
+	if hits != 3 {
+		t.Errorf("%d requests, want 3", hits)
+	}
+
+	resp, err := Get(context.Background(), srv.URL, WithDigestAuth("admin", "wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d", resp.StatusCode())
+	}
+}
+
+func TestAWSSigV4(t *testing.T) {
+	//AWS文档中的示例
+	request, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signer := &awsSigner{
+		credentials: AWSCredentials{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"},
+		region:      "us-east-1",
+		service:     "iam",
+	}
+	signer.sign(request, awsEmptyBodyHash, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := request.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s\nwant %s", got, want)
+	}
+
+	if got := awsCanonicalPath(&url.URL{Path: "/a b/c"}, true); got != "/a%2520b/c" {
+		t.Errorf("canonical path %q", got)
+	}
+	if got := awsCanonicalQuery(&url.URL{RawQuery: "b=2&a-b=3&a=1&a=0"}); got != "a=0&a=1&a-b=3&b=2" {
+		t.Errorf("canonical query %q", got)
+	}
+}
+
+func TestAWSSigV4_Server(t *testing.T) {
+	credentials := AWSCredentials{AccessKey: "AK", SecretKey: "SK", SessionToken: "session"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//服务端用同样的方法重新签名，比较Authorization
+		body, _ := ioutil.ReadAll(r.Body)
+		at, err := time.Parse(awsTimeFormat, r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		got := r.Header.Get("Authorization")
+		r.URL.Host = r.Host
+		check := &awsSigner{credentials: credentials, region: "cn-north-1", service: "s3"}
+		check.sign(r, sha256Hex(string(body)), at)
+		if got != r.Header.Get("Authorization") || r.Header.Get(awsContentSHA256) != sha256Hex(string(body)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = io.WriteString(w, r.Header.Get(awsSecurityHeader))
+	}))
+	defer srv.Close()
+
+	client := New(WithAWSSigV4(credentials, "cn-north-1", "s3"))
+	resp, err := client.Put(context.Background(), srv.URL+"/bucket/a b.txt?acl=&x=1", WithJSON(Value{"a": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := resp.Text(); resp.StatusCode() != 200 || got != "session" {
+		t.Errorf("status %d, body %q", resp.StatusCode(), got)
+	}
+}
+
+func TestHAR_RecordReplay(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&hits, 1)
+		switch r.URL.Path {
+		case "/flaky":
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = io.WriteString(w, "recovered")
+		case "/bin":
+			_, _ = w.Write([]byte{0xff, 0x00, 0xfe})
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1"})
+			_, _ = fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Query().Get("id"), body)
+		}
+	}))
+	defer srv.Close()
+
+	recorder := NewHARRecorder()
+	client := New(WithHARRecorder(recorder))
+	ctx := context.Background()
+	if _, err := client.Get(ctx, srv.URL+"/flaky", WithRetry(&RetryConfig{Wait: time.Millisecond})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, srv.URL+"/bin"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if _, err := client.Post(ctx, srv.URL+"/echo?id="+id, WithJSON(map[string]string{"id": id}),
+			WithCookies(&http.Cookie{Name: "c", Value: id})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//重试的两次请求都被记录
+	har := recorder.HAR()
+	if len(har.Log.Entries) != 5 || har.Log.Version != "1.2" {
+		t.Fatalf("%d entries, version %q", len(har.Log.Entries), har.Log.Version)
+	}
+	if s := har.Log.Entries[0].Response.Status; s != http.StatusServiceUnavailable {
+		t.Errorf("first entry status %d", s)
+	}
+	post := har.Log.Entries[3]
+	if post.Request.PostData == nil || post.Request.PostData.Text != `{"id":"1"}` ||
+		len(post.Request.Cookies) != 1 || len(post.Request.QueryString) != 1 ||
+		len(post.Response.Cookies) != 1 || post.ServerIPAddress != "127.0.0.1" {
+		t.Errorf("post entry %+v", post)
+	}
+	if c := har.Log.Entries[2].Response.Content; c.Encoding != "base64" || c.Size != 3 {
+		t.Errorf("binary content %+v", c)
+	}
+
+	path := t.TempDir() + "/traffic.har"
+	if err := recorder.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := LoadHAR(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	offline := New(WithClient(&http.Client{Transport: replay}))
+	resp, err := offline.Post(ctx, srv.URL+"/echo?id=2", WithJSON(map[string]string{"id": "2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != `POST 2 {"id":"2"}` || resp.Header().Get("Set-Cookie") == "" {
+		t.Errorf("replayed %q %v", text, resp.Header())
+	}
+	if body, _ := offline.Get(ctx, srv.URL+"/bin"); !bytes.Equal(mustContent(body), []byte{0xff, 0x00, 0xfe}) {
+		t.Errorf("replayed binary %v", mustContent(body))
+	}
+	//相同的请求按记录的顺序返回
+	for _, want := range []int{503, 200, 200} {
+		resp, err := offline.Get(ctx, srv.URL+"/flaky")
+		if err != nil || resp.StatusCode() != want {
+			t.Errorf("flaky status %d, want %d, %v", resp.StatusCode(), want, err)
+		}
+	}
+	if _, err := offline.Post(ctx, srv.URL+"/echo?id=2", WithJSON(map[string]string{"id": "3"})); !errors.Is(err, ErrHARNotFound) {
+		t.Errorf("different body: %v", err)
+	}
+}
+
+func TestHAR_Redirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s1", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		default:
+			_, _ = io.WriteString(w, "home")
+		}
+	}))
+	defer srv.Close()
+
+	jar := NewCookieJar()
+	u, _ := url.Parse(srv.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: "lang", Value: "en", Path: "/"}})
+	recorder := NewHARRecorder()
+	resp, err := New(WithCookieJar(jar), WithHARRecorder(recorder)).Get(context.Background(), srv.URL+"/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != "home" {
+		t.Fatalf("body %q", text)
+	}
+
+	//每一跳都是一条记录，header是实际发送的
+	entries := recorder.HAR().Log.Entries
+	if len(entries) != 2 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	header := func(entry HAREntry, name string) string {
+		var values []string
+		for _, h := range entry.Request.Headers {
+			if strings.EqualFold(h.Name, name) {
+				values = append(values, h.Value)
+			}
+		}
+		return strings.Join(values, "; ")
+	}
+	login, home := entries[0], entries[1]
+	if login.Request.URL != srv.URL+"/login" || login.Response.Status != http.StatusFound ||
+		login.Response.RedirectURL != "/home" || len(login.Response.Cookies) != 1 {
+		t.Errorf("login entry %+v", login)
+	}
+	if header(login, "Cookie") != "lang=en" || header(login, "User-Agent") == "" ||
+		header(login, "Accept-Encoding") != "gzip" || header(login, "Host") != u.Host {
+		t.Errorf("login headers %+v", login.Request.Headers)
+	}
+	if home.Request.URL != srv.URL+"/home" || home.Response.Status != http.StatusOK || home.Response.Content.Text != "home" {
+		t.Errorf("home entry %+v", home)
+	}
+	if c := header(home, "Cookie"); c != "lang=en; sid=s1" || len(home.Request.Cookies) != 2 {
+		t.Errorf("home cookies %q %+v", c, home.Request.Cookies)
+	}
+}
+
+//调用方设置Accept-Encoding时收到的是压缩的body，HAR中记录解压后的内容，回放时不再有Content-Encoding
+func TestHAR_ContentEncoding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, "compressed page")
+		_ = gz.Close()
+	}))
+	defer srv.Close()
+
+	recorder := NewHARRecorder()
+	get := func(client *http.Client) *http.Response {
+		request, _ := http.NewRequest("GET", srv.URL, nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := get(&http.Client{Transport: recorder.Transport(nil)})
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("caller did not get the compressed body: %v", err)
+	}
+	if body, _ := ioutil.ReadAll(gz); string(body) != "compressed page" {
+		t.Errorf("caller body %q", body)
+	}
+	_ = resp.Body.Close()
+
+	content := recorder.HAR().Log.Entries[0].Response.Content
+	if content.Text != "compressed page" || content.Size != int64(len("compressed page")) {
+		t.Errorf("recorded content %+v", content)
+	}
+
+	replay, err := NewHARReplay(recorder.HAR())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = get(&http.Client{Transport: replay})
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "compressed page" || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("replayed %q %v", body, resp.Header)
+	}
+}
+
+func TestHAR_Raw(t *testing.T) {
+	ln, _ := newRawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	defer ln.Close()
+
+	recorder := NewHARRecorder()
+	target := "http://" + ln.Addr().String()
+	raw := []byte("POST /a.cgi?x=1 HTTP/1.1\r\nHost: evil\r\nContent-Length: 3\r\n\r\nabc")
+	if _, err := Raw(context.Background(), target, raw, WithHARRecorder(recorder)); err != nil {
+		t.Fatal(err)
+	}
+	har := recorder.HAR()
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("%d entries", len(har.Log.Entries))
+	}
+	entry := har.Log.Entries[0]
+	if entry.Request.Method != "POST" || entry.Request.URL != target+"/a.cgi?x=1" ||
+		entry.Request.PostData == nil || entry.Request.PostData.Text != "abc" {
+		t.Errorf("request %+v", entry.Request)
+	}
+
+	replay, err := NewHARReplay(har)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := Raw(context.Background(), target, raw, WithClient(&http.Client{Transport: replay}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != "ok" {
+		t.Errorf("replayed %q", text)
+	}
+}
+
+func mustContent(resp *Response) []byte {
+	buf, _ := resp.Content()
+	return buf
+}
+
+func TestMultipart(t *testing.T) {
+	type received struct {
+		length   int64
+		chunked  bool
+		parts    []string
+		header   []string
+		contents []string
+	}
+	ch := make(chan received, 4)
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got := received{length: r.ContentLength, chunked: len(r.TransferEncoding) > 0}
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			buf, _ := ioutil.ReadAll(part)
+			got.parts = append(got.parts, part.Header.Get("Content-Disposition"))
+			got.header = append(got.header, part.Header.Get("Content-Type"))
+			got.contents = append(got.contents, string(buf))
+		}
+		ch <- got
+	}))
+	defer srv.Close()
+
+	path := t.TempDir() + "/a.txt"
+	if err := ioutil.WriteFile(path, []byte("file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	shell := BytesPart("upload", `..\..\shell.php`, []byte("<?php ?>"))
+	shell.ContentType = "image/jpeg"
+	parts := []*Part{FieldPart("b", "2"), FieldPart("a", "1"), FilePart("file", path), shell}
+
+	//长度已知时带Content-Length，重试时重新生成body
+	resp, err := Post(context.Background(), srv.URL, WithMultipart(parts...), WithRetry(&RetryConfig{Wait: time.Millisecond}))
+	if err != nil || resp.Retries() != 1 {
+		t.Fatal(resp.Retries(), err)
+	}
+	got := <-ch
+	if got.length <= 0 || got.chunked {
+		t.Errorf("length %d, chunked %v", got.length, got.chunked)
+	}
+	wantParts := []string{`form-data; name="b"`, `form-data; name="a"`,
+		`form-data; name="file"; filename="a.txt"`, `form-data; name="upload"; filename="..\..\shell.php"`}
+	if strings.Join(got.parts, "|") != strings.Join(wantParts, "|") {
+		t.Errorf("parts %q", got.parts)
+	}
+	if strings.Join(got.contents, "|") != "2|1|file|<?php ?>" || got.header[2] != "application/octet-stream" || got.header[3] != "image/jpeg" {
+		t.Errorf("contents %q, types %q", got.contents, got.header)
+	}
+
+	//长度未知的Reader使用chunked发送
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write(bytes.Repeat([]byte("x"), 1<<20))
+		_ = pw.Close()
+	}()
+	if _, err := Post(context.Background(), srv.URL, WithMultipart(ReaderPart("big", "big.bin", pr))); err != nil {
+		t.Fatal(err)
+	}
+	got = <-ch
+	if !got.chunked || len(got.contents) != 1 || len(got.contents[0]) != 1<<20 {
+		t.Errorf("chunked %v, %d parts", got.chunked, len(got.contents))
+	}
+
+	if _, err := Post(context.Background(), srv.URL, WithFile(&File{Path: t.TempDir() + "/missing", Name: "f"})); err == nil {
+		t.Error("missing file: no error")
+	}
+
+	//基础配置中的multipart被每个请求重新生成，Reader只能读取一次，不能放在基础配置中
+	client := New(WithMultipart(FieldPart("a", "1")))
+	for i := 0; i < 2; i++ {
+		if _, err := client.Post(context.Background(), srv.URL); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-ch; strings.Join(got.contents, "|") != "1" {
+			t.Errorf("request %d: contents %q", i, got.contents)
+		}
+	}
+	client = New(WithMultipart(ReaderPart("f", "f.bin", strings.NewReader("once"))))
+	if _, err := client.Post(context.Background(), srv.URL); err == nil {
+		t.Error("Reader part in base options: no error")
+	}
+}
+
+func newClientCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	var sni atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client string
+		if len(r.TLS.PeerCertificates) > 0 {
+			client = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		_, _ = io.WriteString(w, client)
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni.Store(hello.ServerName)
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	ctx := context.Background()
+
+	if _, err := Get(ctx, srv.URL); err == nil {
+		t.Error("unverified certificate: no error")
+	}
+	resp, err := Get(ctx, srv.URL, WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := resp.Certificates()
+	if len(certs) != 1 || certs[0].DNSNames[0] != "example.com" || certs[0].IPAddresses[0] != "127.0.0.1" ||
+		certs[0].Expired() || len(certs[0].SHA256) != 64 {
+		t.Errorf("certificates %+v", certs)
+	}
+
+	//使用服务端证书作为根证书，SNI指定为证书中的域名
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	client := New(WithRootCAs(pool), WithServerName("example.com"))
+	resp, err = client.Get(ctx, srv.URL, WithClientCert(newClientCert(t)),
+		WithTLSVersion(tls.VersionTLS12, tls.VersionTLS12),
+		WithCipherSuites(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != "client" || sni.Load() != "example.com" {
+		t.Errorf("client cert %q, sni %v", text, sni.Load())
+	}
+	if state := resp.TLS(); state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("version %x, cipher %x", state.Version, state.CipherSuite)
+	}
+
+	//请求的选项不影响client
+	resp, err = client.Get(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.Text(); text != "" || resp.TLS().Version != tls.VersionTLS13 {
+		t.Errorf("client cert %q, version %x", text, resp.TLS().Version)
+	}
+	if _, err := client.Get(ctx, srv.URL, WithServerName("other.com")); err == nil {
+		t.Error("wrong server name: no error")
+	}
+
+	//raw请求使用相同的配置
+	resp, err = Raw(ctx, srv.URL, []byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"), WithInsecure(),
+		WithServerName("raw.example.com"))
+	if err != nil || len(resp.Certificates()) != 1 || sni.Load() != "raw.example.com" {
+		t.Errorf("raw: %v, sni %v", err, sni.Load())
+	}
+
+	//相同的配置共用transport
+	a, _ := withTLS(http.DefaultClient, &tls.Config{InsecureSkipVerify: true})
+	b, _ := withTLS(http.DefaultClient, &tls.Config{InsecureSkipVerify: true})
+	if a.Transport != b.Transport || a.Transport == http.DefaultTransport {
+		t.Error("transport not shared")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+			http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		}
+		var cookies []string
+		for _, c := range r.Cookies() {
+			cookies = append(cookies, c.Name+"="+c.Value)
+		}
+		_, _ = io.WriteString(w, strings.Join(cookies, ";"))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	//跳转过程中设置的cookie也在Response中
+	jar := NewCookieJar()
+	worker := New(WithCookieJar(jar))
+	resp, err := worker.Get(ctx, srv.URL+"/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range resp.Cookies() {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "sid,theme" {
+		t.Errorf("response cookies %v", names)
+	}
+
+	//共享jar的client之间共享登录状态，WithCookies只作用于当前请求
+	other := New(WithCookieJar(jar))
+	resp, _ = other.Get(ctx, srv.URL+"/me", WithCookies(&http.Cookie{Name: "once", Value: "1"}))
+	if text, _ := resp.Text(); text != "once=1;sid=1;theme=dark" {
+		t.Errorf("shared jar sent %q", text)
+	}
+	resp, _ = other.Get(ctx, srv.URL+"/me")
+	if text, _ := resp.Text(); text != "sid=1;theme=dark" {
+		t.Errorf("WithCookies kept in jar: %q", text)
+	}
+	if other.CookieJar() != jar || New().CookieJar() != nil {
+		t.Error("CookieJar() did not return the client's jar")
+	}
+
+	//保存后重新加载
+	path := t.TempDir() + "/cookies.json"
+	if err := jar.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCookieJar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Entries(srv.URL); len(got) != 2 || got[0].Name != "sid" || !got[0].HostOnly {
+		t.Errorf("loaded %+v", got)
+	}
+	resp, _ = Get(ctx, srv.URL+"/me", WithCookieJar(loaded))
+	if text, _ := resp.Text(); text != "sid=1;theme=dark" {
+		t.Errorf("loaded jar sent %q", text)
+	}
+	if empty, err := LoadCookieJar(t.TempDir() + "/missing.json"); err != nil || len(empty.Entries("")) != 0 {
+		t.Errorf("missing file: %v", err)
+	}
+
+	loaded.Clear(srv.URL)
+	if got := loaded.Entries(""); len(got) != 0 {
+		t.Errorf("after Clear %+v", got)
+	}
+}
+
+func TestCookieJar_Rules(t *testing.T) {
+	jar := NewCookieJar()
+	set := func(rawurl string, cookies ...*http.Cookie) {
+		u, _ := url.Parse(rawurl)
+		jar.SetCookies(u, cookies)
+	}
+	get := func(rawurl string) string {
+		u, _ := url.Parse(rawurl)
+		var names []string
+		for _, c := range jar.Cookies(u) {
+			names = append(names, c.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	set("http://a.example.com/app/login",
+		&http.Cookie{Name: "host", Value: "1"},
+		&http.Cookie{Name: "domain", Value: "1", Domain: ".example.com", Path: "/"},
+		&http.Cookie{Name: "suffix", Value: "1", Domain: "com"},
+		&http.Cookie{Name: "foreign", Value: "1", Domain: "other.com"},
+		&http.Cookie{Name: "secure", Value: "1", Path: "/", Secure: true},
+		&http.Cookie{Name: "deep", Value: "1", Path: "/app/admin"},
+	)
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://a.example.com/app/x", "host,domain"},
+		{"https://a.example.com/app/admin/x", "deep,host,domain,secure"},
+		{"http://a.example.com/application", "domain"},
+		{"http://b.example.com/app/x", "domain"},
+		{"http://example.com/", "domain"},
+		{"http://other.com/", ""},
+	}
+	for _, tt := range tests {
+		if got := get(tt.url); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	//Max-Age<0删除cookie
+	set("http://a.example.com/", &http.Cookie{Name: "domain", Domain: "example.com", Path: "/", MaxAge: -1})
+	set("http://a.example.com/app/", &http.Cookie{Name: "short", Value: "1", Expires: time.Now().Add(-time.Hour)})
+	if got := get("http://a.example.com/app/x"); got != "host" {
+		t.Errorf("after delete: %q", got)
+	}
+	if got := len(jar.Entries("b.example.com")); got != 0 {
+		t.Errorf("b.example.com has %d cookies", got)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	var lookups int64
+	cache := NewDNSCache(50 * time.Millisecond)
+	cache.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt64(&lookups, 1)
+		time.Sleep(10 * time.Millisecond)
+		if host == "missing.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	ctx := context.Background()
+
+	//同时解析同一个域名只查询一次
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if addrs, err := cache.LookupIPAddr(ctx, "target.test"); err != nil || addrs[0].String() != "127.0.0.1" {
+				t.Errorf("lookup %v, %v", addrs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&lookups); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+
+	//失败的结果也会缓存
+	for i := 0; i < 2; i++ {
+		if _, err := cache.LookupIPAddr(ctx, "missing.test"); err == nil {
+			t.Error("missing.test resolved")
+		}
+	}
+	if n := atomic.LoadInt64(&lookups); n != 2 {
+		t.Errorf("%d lookups, want 2", n)
+	}
+
+	//过期后重新解析，IP不查询
+	time.Sleep(60 * time.Millisecond)
+	_, _ = cache.LookupIPAddr(ctx, "target.test")
+	_, _ = cache.LookupIPAddr(ctx, "::1")
+	if n := atomic.LoadInt64(&lookups); n != 3 {
+		t.Errorf("%d lookups, want 3", n)
+	}
+}
+
+func TestDNSCache_CanceledCaller(t *testing.T) {
+	release := make(chan struct{})
+	cache := NewDNSCache(time.Minute)
+	cache.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	//第一个调用者被取消，同时等待的调用者仍然得到解析结果
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := cache.LookupIPAddr(first, "target.test")
+		firstErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan error)
+	go func() {
+		addrs, err := cache.LookupIPAddr(context.Background(), "target.test")
+		if err == nil && addrs[0].String() != "127.0.0.1" {
+			err = fmt.Errorf("addrs %v", addrs)
+		}
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("canceled caller: %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("waiting caller: %v", err)
+	}
+	if _, err := cache.LookupIPAddr(context.Background(), "target.test"); err != nil {
+		t.Errorf("cached: %v", err)
+	}
+}
+
+type fakeConn struct {
+	net.Conn
+	addr string
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func TestDialer_HappyEyeballs(t *testing.T) {
+	cache := NewDNSCache(time.Minute)
+	cache.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("2001:db8::2")},
+			{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	var mu sync.Mutex
+	var dialed []string
+	canceled := make(chan string, 4)
+	dialer := &Dialer{Timeout: time.Second, FallbackDelay: 20 * time.Millisecond, DNS: cache}
+	dialer.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		switch address {
+		case "[2001:db8::1]:80":
+			return nil, errors.New("refused")
+		case "[2001:db8::2]:80":
+			//IPv6不通，一直等到被取消
+			<-ctx.Done()
+			canceled <- address
+			return nil, ctx.Err()
+		}
+		return &fakeConn{addr: address}, nil
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(context.Background(), "tcp", "target.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.(*fakeConn).addr; got != "192.0.2.1:80" {
+		t.Errorf("connected to %s", got)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+		t.Errorf("fallback after %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("slow IPv6 dial was not canceled")
+	}
+	mu.Lock()
+	if strings.Join(dialed, ",") != "[2001:db8::1]:80,[2001:db8::2]:80,192.0.2.1:80" {
+		t.Errorf("dialed %v", dialed)
+	}
+	mu.Unlock()
+
+	if _, err := dialer.DialContext(context.Background(), "tcp4", "target.test:80"); err != nil {
+		t.Errorf("tcp4: %v", err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	var conns int64
+	transport := NewTransport(TransportConfig{Insecure: true})
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		atomic.AddInt64(&conns, 1)
+		return dial(ctx, network, address)
+	}
+	client := New(WithClient(&http.Client{Transport: transport}))
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(context.Background(), "https://localhost:"+u.Port())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text, _ := resp.Text(); text != "ok" {
+			t.Fatalf("body %q", text)
+		}
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	//默认的transport验证证书
+	if _, err := Get(context.Background(), srv.URL); err == nil {
+		t.Error("DefaultTransport accepted an unverified certificate")
+	}
+}
+
+func TestTransportCache(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	cache := newTransportCache(2)
+	base := &http.Transport{}
+	created := 0
+	get := func(config string) *http.Transport {
+		transport, _ := cache.get(transportKey{base: base, config: config}, func() (*http.Transport, error) {
+			created++
+			return base.Clone(), nil
+		})
+		return transport
+	}
+
+	a := get("a")
+	resp, err := (&http.Client{Transport: a}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	//a最近使用过，移除的是b
+	get("b")
+	if get("a") != a {
+		t.Error("a not cached")
+	}
+	get("c")
+	if get("a") != a || created != 3 {
+		t.Errorf("a evicted, %d created", created)
+	}
+	//再加入b、c时移除a，同时关闭它的空闲连接
+	get("b")
+	get("c")
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("idle connection of the evicted transport not closed")
+	}
+	if created != 5 || get("a") == a {
+		t.Errorf("a not evicted, %d created", created)
+	}
+}
+
+//每个请求新建transport(以前fingerscan的用法)和共用transport的对比
+func BenchmarkTransport(b *testing.B) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	b.Run("new", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+				if _, err := Get(ctx, srv.URL, WithClient(&http.Client{Transport: transport})); err != nil {
+					b.Error(err)
+				}
+				transport.CloseIdleConnections()
+			}
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		client := &http.Client{Transport: NewTransport(TransportConfig{Insecure: true})}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := Get(ctx, srv.URL, WithClient(client)); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkDNSCache(b *testing.B) {
+	ctx := context.Background()
+	b.Run("resolver", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := net.DefaultResolver.LookupIPAddr(ctx, "localhost"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cache", func(b *testing.B) {
+		cache := NewDNSCache(time.Minute)
+		for i := 0; i < b.N; i++ {
+			if _, err := cache.LookupIPAddr(ctx, "localhost"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	metrics := NewMetrics("test")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+	client := New(WithMetrics(metrics, "poc-a"))
+	ctx := context.Background()
+	for _, path := range []string{"/", "/", "/missing"} {
+		if _, err := client.Get(ctx, srv.URL+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Get(ctx, "http://"+closedAddr+"/", WithMetrics(metrics, "poc-b")); err == nil {
+		t.Fatal("closed port: no error")
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, label := range m.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			key := family.GetName() + "{" + strings.Join(labels, ",") + "}"
+			switch {
+			case m.Counter != nil:
+				got[key] = m.Counter.GetValue()
+			case m.Gauge != nil:
+				got[key] = m.Gauge.GetValue()
+			case m.Histogram != nil:
+				got[key] = float64(m.Histogram.GetSampleCount())
+			}
+		}
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	want := map[string]float64{
+		"test_requests_responses_total{code=200,host=" + host + ",module=poc-a}":          2,
+		"test_requests_responses_total{code=404,host=" + host + ",module=poc-a}":          1,
+		"test_requests_errors_total{host=" + closedAddr + ",module=poc-b,reason=connect}": 1,
+		"test_requests_phase_seconds{host=" + host + ",module=poc-a,phase=total}":         3,
+		"test_requests_phase_seconds{host=" + host + ",module=poc-a,phase=first_byte}":    3,
+		"test_requests_phase_seconds{host=" + host + ",module=poc-a,phase=connect}":       1,
+		"test_requests_in_flight{host=" + host + ",module=poc-a}":                         0,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+	if t.Failed() {
+		t.Logf("gathered %v", got)
+	}
+}
+
+func TestResponse_Query(t *testing.T) {
+	page := `<html><head><meta charset="gbk"><title>登录</title></head><body>
+<form id="login" action="/login"><input name="user"><input type="hidden" name="token" value="abc123"></form>
+<ul><li class="item a">one</li><li class="item">two</li><li>three</li></ul>
+<a href="/x?a=1">first</a><a href="/y">Version 2.3.1</a></body></html>`
+	gbk := mahonia.NewEncoder("gbk").ConvertString(page)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"data":{"items":[{"id":9007199254740993,"token":"t1"},{"id":2,"token":"t2"}]},"meta":{"":"blank","version":"1.0"},"version":"2.0"}`)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, gbk)
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := Get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Charset() != "GBK" {
+		t.Errorf("charset %q", resp.Charset())
+	}
+	if text, _ := resp.DecodedText(); text != page {
+		t.Errorf("decoded %q", text)
+	}
+
+	//mahonia不认识的常用名称
+	charsets := []struct {
+		contentType, page, encoding, want string
+	}{
+		{"text/html; charset=gb2312", "<p>管理后台</p>", "GBK", "GBK"},
+		{"text/html", `<meta http-equiv="Content-Type" content="text/html; charset=GB2312"><p>管理后台</p>`, "GBK", "GBK"},
+		{"text/html; charset=big5", "<p>繁體登入</p>", "Big5", "Big5"},
+		{"text/html", `<meta charset='big5'><p>繁體登入</p>`, "Big5", "Big5"},
+		{"text/html; charset=unknown-label", "<p>管理后台</p>", "GB18030", "GB18030"},
+	}
+	for _, tt := range charsets {
+		body := mahonia.NewEncoder(tt.encoding).ConvertString(tt.page)
+		resp := &Response{resp: &http.Response{Header: http.Header{"Content-Type": {tt.contentType}}}, body: []byte(body)}
+		if charset := resp.Charset(); charset != tt.want {
+			t.Errorf("%s: charset %q, want %q", tt.contentType, charset, tt.want)
+		}
+		if text, _ := resp.DecodedText(); text != tt.page {
+			t.Errorf("%s: decoded %q", tt.contentType, text)
+		}
+	}
+	if !resp.Contains("abc123") || resp.Contains("missing") {
+		t.Error("Contains")
+	}
+	if title := resp.Find("title").Text(); title != "登录" {
+		t.Errorf("title %q", title)
+	}
+	if token := resp.Find(`form#login input[name="token"]`).AttrOr("value", ""); token != "abc123" {
+		t.Errorf("css token %q", token)
+	}
+	if m, err := resp.Submatch(`Version ([\d.]+)`); err != nil || len(m) != 2 || m[1] != "2.3.1" {
+		t.Errorf("submatch %v, %v", m, err)
+	}
+	if all, _ := resp.AllSubmatch(`href="([^"]+)"`); len(all) != 2 || all[1][1] != "/y" {
+		t.Errorf("all submatch %v", all)
+	}
+
+	xpaths := []struct {
+		expr string
+		want []string
+	}{
+		{`//form[@id='login']//input[@name='token']/@value`, []string{"abc123"}},
+		{`/html/head/title`, []string{"登录"}},
+		{`//li[1]`, []string{"one"}},
+		{`//li[last()]`, []string{"three"}},
+		{`//li[@class]`, []string{"one", "two"}},
+		{`//li[contains(@class, 'a')]/text()`, []string{"one"}},
+		{`//a[starts-with(., 'Version')]/@href`, []string{"/y"}},
+		{`//a[@href='/x?a=1']`, []string{"first"}},
+		{`//a[text()!='first']`, []string{"Version 2.3.1"}},
+		{`//input[@name='token']/../@action`, []string{"/login"}},
+		{`//ul/*[2]`, []string{"two"}},
+		{`//missing`, []string{}},
+	}
+	for _, tt := range xpaths {
+		got, err := resp.XPath(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%s = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+	for _, expr := range []string{"", "//a[", "//a[@x=y]", "//a[0]"} {
+		if _, err := resp.XPath(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+
+	resp, err = Get(context.Background(), srv.URL+"/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []struct {
+		path string
+		want string
+	}{
+		{`$.data.items[0].token`, "[t1]"},
+		{`$.data.items[-1].id`, "[2]"},
+		{`$.data.items[0].id`, "[9007199254740993]"},
+		{`$.data.items[*].token`, "[t1 t2]"},
+		{`$['meta']["version"]`, "[1.0]"},
+		{`$..version`, "[2.0 1.0]"},
+		{`$..token`, "[t1 t2]"},
+		{`$.meta.*`, "[blank 1.0]"},
+		{`$.meta['']`, "[blank]"},
+		{`$['']`, "[]"},
+		{`$.missing`, "[]"},
+	}
+	for _, tt := range paths {
+		got, err := resp.JSONPath(tt.path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if s := fmt.Sprint(got); s != tt.want {
+			t.Errorf("%s = %s, want %s", tt.path, s, tt.want)
+		}
+	}
+	if _, err := resp.JSONPath("$.a[x]"); err == nil {
+		t.Error("bad jsonpath: no error")
+	}
+
+	var empty *Response
+	if _, err := empty.XPath("//a"); err != ErrNoResponse {
+		t.Errorf("nil response: %v", err)
+	}
+	if empty.Find("a").Length() != 0 || empty.Contains("") {
+		t.Error("nil response matched")
+	}
+}
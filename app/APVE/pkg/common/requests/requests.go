@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptrace"
+	"sync/atomic"
 )
 
 type Http interface {
@@ -23,7 +24,7 @@ type Http interface {
 
 var _ Http = New()
 
-var defaultReq = New(WithClient(http.DefaultClient))
+var defaultReq = New()
 
 func Get(ctx context.Context, url string, opts ...DialOption) (*Response, error) {
 	return defaultReq.do(ctx, http.MethodGet, url, opts...)
@@ -65,6 +66,8 @@ func Do(ctx context.Context, method, url string, opts ...DialOption) (*Response,
 	return defaultReq.do(ctx, method, url, opts...)
 }
 
+//Client 创建后基础配置不再改变，可以在多个goroutine中同时使用
+//每个请求的配置都在基础配置的副本上叠加，不会影响其他请求
 type Client struct {
 	opts    dialOptions
 	Request *http.Request
@@ -79,6 +82,7 @@ func New(opts ...DialOption) *Client {
 	for _, opt := range opts {
 		opt(&req.opts)
 	}
+	req.opts.freeze()
 	return req
 }
 
@@ -128,58 +132,123 @@ func (req *Client) Do(ctx context.Context, method, url string, opts ...DialOptio
 	return req.do(ctx, method, url, opts...)
 }
 
-func (req Client) do(ctx context.Context, method string, url string, opts ...DialOption) (*Response, error) {
+func (req *Client) do(ctx context.Context, method string, url string, opts ...DialOption) (*Response, error) {
+	//每个请求使用基础配置的副本，请求的配置不会写回client
+	o := req.opts.clone()
 	for _, opt := range opts {
-		opt(&req.opts)
+		opt(&o)
 	}
 
 	// set params error
-	if req.opts.err != nil {
-		return nil, req.opts.err
+	if o.err != nil {
+		return nil, o.err
 	}
 
-	if req.opts.query != "" {
-		url += "?" + req.opts.query
+	if o.query != "" {
+		url += "?" + o.query
 	}
 
-	if req.opts.trace != nil {
-		ctx = httptrace.WithClientTrace(ctx, req.opts.trace)
+	if o.trace != nil {
+		ctx = httptrace.WithClientTrace(ctx, o.trace)
+	}
+	trace := newTracer()
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	ctx, retries := withRetryCount(ctx)
+
+	body := o.requestBody()
+	if o.raw != nil {
+		//raw请求由exec原样发送
+		ctx = context.WithValue(ctx, rawKey{}, o.raw)
+		body = nil
 	}
 
-	request, err := http.NewRequestWithContext(ctx, method, url, req.opts.body)
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
+	if o.upload != nil && o.raw == nil {
+		o.upload.apply(request)
+	}
+
 	//set request headers
-	for k, v := range req.opts.headers {
+	for k, v := range o.headers {
 		request.Header.Set(k, v)
 	}
 
 	//set http client
-	client := req.opts.client
+	client := o.client
 	if client == nil {
-		client = http.DefaultClient
-		req.opts.client = client
+		client = DefaultClient
 	}
 
 	//set cookies
-	if !req.opts.session {
-		client.Jar = nil
+	//不开启session时使用client的副本，不能修改共享的client(比如http.DefaultClient)
+	if !o.session && client.Jar != nil {
+		c := *client
+		c.Jar = nil
+		client = &c
+	}
+	//请求单独指定的jar
+	if o.jar != nil && client.Jar != http.CookieJar(o.jar) {
+		c := *client
+		c.Jar = o.jar
+		client = &c
+	}
+	redirects := &redirectCookies{}
+	client = redirects.wrap(client)
+
+	//set tls
+	if o.tls != nil {
+		if client, err = withTLS(client, o.tls); err != nil {
+			return nil, err
+		}
+	}
+
+	//set proxy
+	if o.proxy != nil {
+		if client, err = withProxy(client, o.proxy); err != nil {
+			return nil, err
+		}
 	}
 
+	middles := o.middles
 	//debug
-	if req.opts.debug {
+	if o.debug {
 		//debug的日志中间件放在最外层
-		req.opts.middles = append([]Middleware{loggerMiddleware()}, req.opts.middles...)
+		middles = append([]Middleware{loggerMiddleware()}, middles...)
 	}
 	//将重试的中间件加到最后一个，这样重试的时候执行的代码就是最后请求的方法
-	if req.opts.retry != nil {
-		req.opts.middles = append(req.opts.middles, req.opts.retry)
+	if o.retry != nil {
+		middles = append(middles, o.retry)
+	}
+	//认证在重试之后，重试和认证的challenge请求都会重新认证
+	if o.auth != nil {
+		middles = append(middles, o.auth)
+	}
+	//限流在重试之后，每次重试都会被限制
+	if o.limiter != nil {
+		middles = append(middles, o.limiter.Middleware())
+	}
+	//指标和记录在最内层，记录的是实际发送的每个请求
+	if o.metrics != nil {
+		middles = append(middles, o.metrics)
+	}
+	if o.har != nil {
+		middles = append(middles, o.har.Middleware())
+	}
+	r, err := Chain(middles...)(exec)(client, request)
+	if o.upload != nil && request.Body != nil {
+		//中间件没有发送请求时，结束写入body的goroutine
+		_ = request.Body.Close()
+	}
+	//读取body，请求本身的错误优先
+	resp, readErr := newResponse(r, o.maxSize, trace)
+	resp.retries = int(atomic.LoadInt32(retries))
+	resp.redirectCookies = redirects.get()
+	if err == nil {
+		err = readErr
 	}
-	r, err := Chain(req.opts.middles...)(exec)(client, request)
-	resp := &Response{resp: r}
-
 	return resp, err
 }
 
@@ -204,7 +273,11 @@ func exec(client *http.Client, request *http.Request) (*http.Response, error) {
 			}
 		}()
 
-		resp, err = client.Do(request)
+		if raw, ok := rawPayload(request.Context()); ok {
+			resp, err = sendRaw(client, request, raw)
+		} else {
+			resp, err = client.Do(request)
+		}
 		c <- err
 	}()
 
@@ -212,6 +285,9 @@ func exec(client *http.Client, request *http.Request) (*http.Response, error) {
 	select {
 	case <-ctx.Done():
 		<-c
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
 		return nil, ctx.Err()
 	case err := <-c:
 		return resp, err
@@ -1,44 +1,315 @@
 package requests
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"sync"
+	"time"
 )
 
+//默认最多读取的body大小
+const DefaultMaxSize = 10 << 20
+
+//请求失败时返回的Response没有内容
+var ErrNoResponse = errors.New("requests: no response")
+
+//Response 读取并缓存了body的响应，可以多次读取，可以在多个goroutine中同时使用
+//body超过MaxSize的部分会被丢弃，Truncated返回true
 type Response struct {
-	resp *http.Response
+	resp      *http.Response
+	body      []byte
+	truncated bool
+	timing    Timing
+	remote    string
+	retries   int
+	//跳转过程中设置的cookie
+	redirectCookies []*http.Cookie
+}
+
+//请求各阶段的耗时，没有经过的阶段为0
+//重试和跳转时DNS、Connect、TLS、FirstByte记录的是最后一次发送的请求，复用连接时前三项为0
+type Timing struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	//从获取连接到收到第一个字节
+	FirstByte time.Duration
+	//从开始请求到读取完body，包括重试和跳转
+	Total time.Duration
+}
+
+//记录请求过程，transport可能在多个goroutine中调用
+type tracer struct {
+	mu    sync.Mutex
+	start time.Time
+	//最后一次获取连接的时间，之前的请求记录的阶段在这时清空
+	sent      time.Time
+	dnsStart  time.Time
+	dns       time.Duration
+	connStart time.Time
+	connect   time.Duration
+	tlsStart  time.Time
+	tls       time.Duration
+	firstByte time.Time
+	remote    string
+}
+
+func newTracer() *tracer {
+	now := time.Now()
+	return &tracer{start: now, sent: now}
+}
+
+func (t *tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			t.sent = time.Now()
+			t.dns, t.connect, t.tls = 0, 0, 0
+			t.connStart, t.firstByte = time.Time{}, time.Time{}
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dns = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			if t.connStart.IsZero() {
+				t.connStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			if err == nil {
+				t.connect = time.Since(t.connStart)
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.tls = time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.remote = info.Conn.RemoteAddr().String()
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now()
+			t.mu.Unlock()
+		},
+	}
 }
 
+//读取body，生成Response
+func newResponse(r *http.Response, maxSize int64, trace *tracer) (*Response, error) {
+	resp := &Response{resp: r}
+	var err error
+	if r != nil && r.Body != nil {
+		resp.body, resp.truncated, err = readBody(r.Body, maxSize)
+		_ = r.Body.Close()
+		r.Body = http.NoBody
+	}
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	resp.timing = Timing{
+		DNS:     trace.dns,
+		Connect: trace.connect,
+		TLS:     trace.tls,
+		Total:   time.Since(trace.start),
+	}
+	if !trace.firstByte.IsZero() {
+		resp.timing.FirstByte = trace.firstByte.Sub(trace.sent)
+	}
+	resp.remote = trace.remote
+	return resp, err
+}
+
+//最多读取maxSize，maxSize为0时使用DefaultMaxSize，小于0时不限制
+func readBody(body io.Reader, maxSize int64) ([]byte, bool, error) {
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxSize < 0 {
+		buf, err := ioutil.ReadAll(body)
+		return buf, false, err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxSize+1))
+	if int64(len(buf)) > maxSize {
+		return buf[:maxSize], true, err
+	}
+	return buf, false, err
+}
+
+//请求失败时没有响应，nil也可以调用Response的方法
+func (r *Response) empty() bool {
+	return r == nil || r.resp == nil
+}
+
+//兼容以前的用法，body已经读取，不需要关闭
 func (r *Response) Close() error {
-	return r.resp.Body.Close()
+	return nil
 }
 
 //原始的Response对象
+//每次返回一个副本，Body可以读取缓存的内容
 func (r *Response) Response() *http.Response {
-	return r.resp
+	if r.empty() {
+		return nil
+	}
+	resp := *r.resp
+	resp.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+	return &resp
+}
+
+//状态码，没有响应时为0
+func (r *Response) StatusCode() int {
+	if r.empty() {
+		return 0
+	}
+	return r.resp.StatusCode
+}
+
+//状态行，eg: 200 OK
+func (r *Response) Status() string {
+	if r.empty() {
+		return ""
+	}
+	return r.resp.Status
+}
+
+func (r *Response) Header() http.Header {
+	if r.empty() {
+		return http.Header{}
+	}
+	return r.resp.Header
+}
+
+//body是否超过MaxSize被截断
+func (r *Response) Truncated() bool {
+	if r == nil {
+		return false
+	}
+	return r.truncated
+}
+
+//响应设置的cookie，包括跳转过程中每个响应设置的，按收到的顺序排列
+func (r *Response) Cookies() []*http.Cookie {
+	if r.empty() {
+		return nil
+	}
+	return append(append([]*http.Cookie(nil), r.redirectCookies...), r.resp.Cookies()...)
+}
+
+//请求各阶段的耗时
+func (r *Response) Timing() Timing {
+	if r == nil {
+		return Timing{}
+	}
+	return r.timing
+}
+
+//请求的总耗时
+func (r *Response) Elapsed() time.Duration {
+	return r.Timing().Total
+}
+
+//重试的次数，没有重试时为0
+func (r *Response) Retries() int {
+	if r == nil {
+		return 0
+	}
+	return r.retries
+}
+
+//连接的远程地址，使用代理时是代理的地址
+func (r *Response) RemoteAddr() string {
+	if r == nil {
+		return ""
+	}
+	return r.remote
+}
+
+//TLS连接信息，不是https时返回nil
+func (r *Response) TLS() *tls.ConnectionState {
+	if r.empty() {
+		return nil
+	}
+	return r.resp.TLS
+}
+
+//服务端的证书链，第一个是服务端的证书，不是https时返回nil
+//不验证证书时也会返回
+func (r *Response) Certificates() []Certificate {
+	state := r.TLS()
+	if state == nil {
+		return nil
+	}
+	certs := make([]Certificate, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		certs = append(certs, newCertificate(cert))
+	}
+	return certs
+}
+
+//响应的原始内容，包括状态行、header和body
+//body是解码后缓存的内容，chunked的响应按Content-Length输出
+func (r *Response) Dump() ([]byte, error) {
+	resp := r.Response()
+	if resp == nil {
+		return nil, ErrNoResponse
+	}
+	resp.TransferEncoding = nil
+	resp.ContentLength = int64(len(r.body))
+	return httputil.DumpResponse(resp, true)
 }
 
 //json内容
 func (r *Response) JSON(i interface{}) error {
-	return r.withClose(func() error {
-		return json.NewDecoder(r.resp.Body).Decode(i)
-	})
+	if r.empty() {
+		return ErrNoResponse
+	}
+	return json.Unmarshal(r.body, i)
 }
 
 //XML格式内容
 func (r *Response) XML(i interface{}) error {
-	return r.withClose(func() error {
-		return xml.NewDecoder(r.resp.Body).Decode(i)
-	})
+	if r.empty() {
+		return ErrNoResponse
+	}
+	return xml.Unmarshal(r.body, i)
 }
 
 //二进制内容
+//返回的是缓存的内容，不要修改
 func (r *Response) Content() ([]byte, error) {
-	defer r.resp.Body.Close()
-	return ioutil.ReadAll(r.resp.Body)
+	if r.empty() {
+		return nil, ErrNoResponse
+	}
+	return r.body, nil
 }
 
 //字符串内容
@@ -51,31 +322,21 @@ func (r *Response) Text() (string, error) {
 }
 
 //读取字节流
-//读取完或者遇到错误，会关闭channel
+//读取完会关闭channel，每次发送的都是新的切片
 func (r *Response) Raw() chan []byte {
 	ch := make(chan []byte)
-	buf := make([]byte, 1024*1024)
+	body, _ := r.Content()
 	go func() {
-		defer func() {
-			close(ch)
-			_ = r.resp.Body.Close()
-		}()
-
-		for {
-			n, err := r.resp.Body.Read(buf)
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				return
+		defer close(ch)
+		const chunk = 32 << 10
+		for len(body) > 0 {
+			n := len(body)
+			if n > chunk {
+				n = chunk
 			}
-			ch <- buf[:n]
+			ch <- append([]byte(nil), body[:n]...)
+			body = body[n:]
 		}
 	}()
 	return ch
 }
-
-func (r *Response) withClose(f func() error) error {
-	defer r.resp.Body.Close()
-	return f()
-}
@@ -2,8 +2,11 @@ package requests
 
 import (
 	"context"
-	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,84 +40,172 @@ func newRetry(iretry Retry) *retry {
 	}
 }
 
-func (r *retry) backoff(fn func() (*http.Response, error)) (*http.Response, error) {
+type retryCountKey struct{}
+
+//记录重试次数，结果在Response.Retries中返回
+func withRetryCount(ctx context.Context) (context.Context, *int32) {
+	count := new(int32)
+	return context.WithValue(ctx, retryCountKey{}, count), count
+}
+
+//fn每次调用都需要重新发送请求，attempt从0开始
+func (r *retry) backoff(ctx context.Context, fn func(attempt int) (*http.Response, error)) (*http.Response, error) {
 	var (
 		resp *http.Response
 		err  error
 	)
-	for attempt := 0; attempt <= r.maxRetries; attempt++ {
-		fmt.Printf("retry attempt: %d\n", attempt)
-		var (
-			ctx       context.Context
-			needRetry bool
-		)
-		resp, err = fn()
-		if resp != nil {
-			ctx = resp.Request.Context()
-		}
-		if ctx == nil {
-			ctx = context.Background()
-		}
+	for attempt := 0; ; attempt++ {
+		resp, err = fn(attempt)
 		// context异常直接返回无需重试
 		if ctx.Err() != nil {
-			return nil, err
+			return resp, err
 		}
-		for _, condition := range r.conditions {
-			if condition(resp, err) {
-				needRetry = true
-				break
+		if attempt >= r.maxRetries || !r.needRetry(resp, err) {
+			return resp, err
+		}
+
+		//计算重试间隔时间，不超过最长等待时间
+		waitTime, perr := r.policy(resp, r.waitTime, r.maxWaitTime, attempt)
+		if perr != nil {
+			//策略出错时不再重试，返回策略的错误
+			if resp != nil {
+				_ = resp.Body.Close()
 			}
+			return nil, perr
 		}
-		if !needRetry {
-			return resp, err
+		if r.maxWaitTime > 0 && waitTime > r.maxWaitTime {
+			waitTime = r.maxWaitTime
 		}
-		//计算重试间隔时间
-		waitTime, err := r.policy(resp, r.waitTime, r.maxWaitTime, attempt)
-		if err != nil {
-			return nil, err
+		//服务端指定了Retry-After时至少等待这么久，超过最长等待时间时不再重试，返回这次的响应
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok && after > waitTime {
+				if r.maxWaitTime > 0 && after > r.maxWaitTime {
+					return resp, err
+				}
+				waitTime = after
+			}
 		}
+		//丢弃这次的响应，读完body才能复用连接
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+			_ = resp.Body.Close()
+		}
+
 		timer := time.NewTimer(waitTime)
 		select {
 		case <-timer.C:
 		case <-ctx.Done():
-			//close timer and drain the channel
-			if !timer.Stop() {
-				<-timer.C
-			}
+			timer.Stop()
 			return nil, ctx.Err()
 		}
+		if count, ok := ctx.Value(retryCountKey{}).(*int32); ok {
+			atomic.AddInt32(count, 1)
+		}
 	}
-	return resp, err
 }
 
-type defaultRetry struct {
+func (r *retry) needRetry(resp *http.Response, err error) bool {
+	for _, condition := range r.conditions {
+		if condition(resp, err) {
+			return true
+		}
+	}
+	return false
 }
 
-func (r *defaultRetry) MaxEntries() int {
-	return 3
-}
-func (r *defaultRetry) WaitTime() time.Duration {
-	return 100 * time.Microsecond
-}
-func (r *defaultRetry) MaxWaitTime() time.Duration {
-	return 10 * time.Second
+//请求出错时重试
+func RetryOnError(resp *http.Response, err error) bool {
+	return err != nil
 }
-func (r *defaultRetry) RetryConditions() []RetryCondition {
-	return []RetryCondition{
-		func(resp *http.Response, err error) bool {
-			if err != nil {
+
+//返回指定状态码时重试
+func RetryOnStatus(codes ...int) RetryCondition {
+	return func(resp *http.Response, err error) bool {
+		if err != nil || resp == nil {
+			return false
+		}
+		for _, code := range codes {
+			if resp.StatusCode == code {
 				return true
 			}
-			return false
-		},
+		}
+		return false
+	}
+}
+
+//指数退避，等待时间在[d/2, d]之间随机，d = min * 2^attempt，不超过max
+//多个请求同时失败时不会在同一时间重试
+func ExponentialJitterBackoff(resp *http.Response, min, max time.Duration, attempt int) (time.Duration, error) {
+	wait := min
+	for i := 0; i < attempt && (max <= 0 || wait < max); i++ {
+		wait *= 2
+	}
+	if max > 0 && wait > max {
+		wait = max
+	}
+	if half := int64(wait / 2); half > 0 {
+		wait = time.Duration(half + rand.Int63n(half+1))
 	}
+	return wait, nil
 }
-func (r *defaultRetry) RetryPolicy() RetryPolicy {
-	return func(resp *http.Response, min, max time.Duration, attempt int) (time.Duration, error) {
-		waitTime := min + time.Duration(attempt)*min
-		if waitTime > max {
-			waitTime = max
+
+//RetryConfig 可配置的重试，零值使用默认配置
+type RetryConfig struct {
+	//最多重试次数，nil时默认3次，eg: MaxRetries: Retries(0)不重试
+	MaxRetries *int
+	//第一次重试的等待时间，默认100ms
+	Wait time.Duration
+	//最长等待时间，默认10s
+	MaxWait time.Duration
+	//满足任一条件时重试，默认请求出错或者返回429、502、503、504
+	Conditions []RetryCondition
+	//默认ExponentialJitterBackoff
+	Policy RetryPolicy
+}
+
+//RetryConfig.MaxRetries的值
+func Retries(n int) *int {
+	return &n
+}
+
+func (r *RetryConfig) MaxEntries() int {
+	if r.MaxRetries == nil {
+		return 3
+	}
+	if *r.MaxRetries < 0 {
+		return 0
+	}
+	return *r.MaxRetries
+}
+
+func (r *RetryConfig) WaitTime() time.Duration {
+	if r.Wait <= 0 {
+		return 100 * time.Millisecond
+	}
+	return r.Wait
+}
+
+func (r *RetryConfig) MaxWaitTime() time.Duration {
+	if r.MaxWait <= 0 {
+		return 10 * time.Second
+	}
+	return r.MaxWait
+}
+
+func (r *RetryConfig) RetryConditions() []RetryCondition {
+	if len(r.Conditions) == 0 {
+		return []RetryCondition{
+			RetryOnError,
+			RetryOnStatus(http.StatusTooManyRequests, http.StatusBadGateway,
+				http.StatusServiceUnavailable, http.StatusGatewayTimeout),
 		}
-		return waitTime, nil
 	}
+	return r.Conditions
+}
+
+func (r *RetryConfig) RetryPolicy() RetryPolicy {
+	if r.Policy == nil {
+		return ExponentialJitterBackoff
+	}
+	return r.Policy
 }
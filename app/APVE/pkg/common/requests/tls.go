@@ -0,0 +1,184 @@
+package requests
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//TLS配置只包含设置过的字段，发送时合并到client的transport的TLS配置中
+func (opts *dialOptions) tlsConfig() *tls.Config {
+	if opts.tls == nil {
+		opts.tls = &tls.Config{}
+	}
+	return opts.tls
+}
+
+//不验证服务端证书
+func WithInsecure() DialOption {
+	return func(opts *dialOptions) {
+		opts.tlsConfig().InsecureSkipVerify = true
+	}
+}
+
+//客户端证书
+func WithClientCert(certs ...tls.Certificate) DialOption {
+	return func(opts *dialOptions) {
+		c := opts.tlsConfig()
+		c.Certificates = append(c.Certificates[:len(c.Certificates):len(c.Certificates)], certs...)
+	}
+}
+
+//从PEM文件加载客户端证书
+func WithClientCertFile(certFile, keyFile string) DialOption {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return func(opts *dialOptions) {
+			opts.err = err
+		}
+	}
+	return WithClientCert(cert)
+}
+
+//验证服务端证书使用的根证书，替换系统的根证书
+func WithRootCAs(pool *x509.CertPool) DialOption {
+	return func(opts *dialOptions) {
+		opts.tlsConfig().RootCAs = pool
+	}
+}
+
+//指定SNI，同时用于验证证书的域名
+func WithServerName(name string) DialOption {
+	return func(opts *dialOptions) {
+		opts.tlsConfig().ServerName = name
+	}
+}
+
+//TLS版本范围，eg: tls.VersionTLS10，为0时使用默认值
+func WithTLSVersion(min, max uint16) DialOption {
+	return func(opts *dialOptions) {
+		c := opts.tlsConfig()
+		c.MinVersion, c.MaxVersion = min, max
+	}
+}
+
+//TLS 1.2及以下使用的加密套件，TLS 1.3的加密套件不能配置
+func WithCipherSuites(suites ...uint16) DialOption {
+	return func(opts *dialOptions) {
+		opts.tlsConfig().CipherSuites = suites
+	}
+}
+
+//同一个transport和TLS配置共用一个transport，复用连接
+var tlsTransports = newTransportCache(maxCachedTransports)
+
+//返回使用config的client副本，config中设置了的字段覆盖transport原来的配置
+func withTLS(client *http.Client, config *tls.Config) (*http.Client, error) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("requests: TLS options need an *http.Transport, got %T", base)
+	}
+
+	key := transportKey{base: transport, config: tlsKey(config)}
+	rt, _ := tlsTransports.get(key, func() (*http.Transport, error) {
+		t := transport.Clone()
+		t.TLSClientConfig = mergeTLS(t.TLSClientConfig, config)
+		return t, nil
+	})
+	c := *client
+	c.Transport = rt
+	return &c, nil
+}
+
+func mergeTLS(base, config *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	} else {
+		base = base.Clone()
+	}
+	if config.InsecureSkipVerify {
+		base.InsecureSkipVerify = true
+	}
+	if len(config.Certificates) > 0 {
+		base.Certificates = config.Certificates
+	}
+	if config.RootCAs != nil {
+		base.RootCAs = config.RootCAs
+	}
+	if config.ServerName != "" {
+		base.ServerName = config.ServerName
+	}
+	if config.MinVersion != 0 {
+		base.MinVersion = config.MinVersion
+	}
+	if config.MaxVersion != 0 {
+		base.MaxVersion = config.MaxVersion
+	}
+	if len(config.CipherSuites) > 0 {
+		base.CipherSuites = config.CipherSuites
+	}
+	return base
+}
+
+//区分TLS配置，根证书按CertPool对象区分
+func tlsKey(config *tls.Config) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%s|%d|%d|%v|%p|", config.InsecureSkipVerify, config.ServerName,
+		config.MinVersion, config.MaxVersion, config.CipherSuites, config.RootCAs)
+	for _, cert := range config.Certificates {
+		for _, der := range cert.Certificate {
+			h.Write(der)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//Certificate 证书的主要信息，用于资产发现
+type Certificate struct {
+	Subject    string
+	CommonName string
+	Issuer     string
+	//SAN中的域名、IP和邮箱
+	DNSNames    []string
+	IPAddresses []string
+	Emails      []string
+	Serial      string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	//DER的SHA-256，十六进制
+	SHA256 string
+	Cert   *x509.Certificate `json:"-"`
+}
+
+func newCertificate(cert *x509.Certificate) Certificate {
+	sum := sha256.Sum256(cert.Raw)
+	c := Certificate{
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+		Issuer:     cert.Issuer.String(),
+		DNSNames:   cert.DNSNames,
+		Emails:     cert.EmailAddresses,
+		Serial:     cert.SerialNumber.String(),
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		SHA256:     hex.EncodeToString(sum[:]),
+		Cert:       cert,
+	}
+	for _, ip := range cert.IPAddresses {
+		c.IPAddresses = append(c.IPAddresses, ip.String())
+	}
+	return c
+}
+
+//是否已经过期
+func (c Certificate) Expired() bool {
+	return time.Now().After(c.NotAfter)
+}
@@ -0,0 +1,405 @@
+package requests
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	//包级别的Get、Post等方法和没有指定client的Client使用的transport
+	//所有请求共用连接池和DNS缓存
+	DefaultTransport = NewTransport(TransportConfig{})
+	DefaultClient    = &http.Client{Transport: DefaultTransport}
+)
+
+//TransportConfig 扫描用的transport配置，零值使用默认值
+type TransportConfig struct {
+	//每次建立TCP连接的超时时间，和请求的总超时时间(http.Client.Timeout)分开，默认5秒
+	DialTimeout time.Duration
+	KeepAlive   time.Duration
+	//默认5秒
+	TLSHandshakeTimeout time.Duration
+	//连接池中最多的空闲连接，默认1024
+	MaxIdleConns int
+	//每个host最多的空闲连接，默认16
+	MaxIdleConnsPerHost int
+	//每个host最多的连接，默认不限制
+	MaxConnsPerHost int
+	//空闲连接保留的时间，默认90秒
+	IdleConnTimeout time.Duration
+	//DNS缓存时间，默认1分钟，小于0时不缓存
+	DNSTTL time.Duration
+	//IPv4和IPv6都有地址时，第一种地址连接多久没有成功就同时连接另一种，默认300ms
+	FallbackDelay time.Duration
+	//不验证服务端证书
+	Insecure bool
+}
+
+//创建适合大量扫描的transport，需要共用才能复用连接
+func NewTransport(config TransportConfig) *http.Transport {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = 30 * time.Second
+	}
+	if config.TLSHandshakeTimeout <= 0 {
+		config.TLSHandshakeTimeout = 5 * time.Second
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = 1024
+	}
+	if config.MaxIdleConnsPerHost <= 0 {
+		config.MaxIdleConnsPerHost = 16
+	}
+	if config.IdleConnTimeout <= 0 {
+		config.IdleConnTimeout = 90 * time.Second
+	}
+	if config.DNSTTL == 0 {
+		config.DNSTTL = time.Minute
+	}
+
+	dialer := &Dialer{
+		Timeout:       config.DialTimeout,
+		KeepAlive:     config.KeepAlive,
+		FallbackDelay: config.FallbackDelay,
+	}
+	if config.DNSTTL > 0 {
+		dialer.DNS = NewDNSCache(config.DNSTTL)
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return transport
+}
+
+//最多缓存的派生transport数量
+const maxCachedTransports = 64
+
+//transportCache 缓存基于client的transport派生出的transport(eg: 不同的TLS配置)，复用连接
+//超过容量时移除最久没有使用的，并关闭它的空闲连接，正在进行的请求不受影响
+type transportCache struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List
+	items map[transportKey]*list.Element
+}
+
+type cachedTransport struct {
+	key       transportKey
+	transport *http.Transport
+}
+
+func newTransportCache(max int) *transportCache {
+	return &transportCache{max: max, order: list.New(), items: make(map[transportKey]*list.Element)}
+}
+
+//返回key对应的transport，不存在时使用create创建
+func (c *transportCache) get(key transportKey, create func() (*http.Transport, error)) (*http.Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*cachedTransport).transport, nil
+	}
+
+	transport, err := create()
+	if err != nil {
+		return nil, err
+	}
+	c.items[key] = c.order.PushFront(&cachedTransport{key: key, transport: transport})
+	for c.order.Len() > c.max {
+		oldest := c.order.Remove(c.order.Back()).(*cachedTransport)
+		delete(c.items, oldest.key)
+		oldest.transport.CloseIdleConnections()
+	}
+	return transport, nil
+}
+
+//缓存的域名最多数量，超过时清理过期的记录
+const maxDNSEntries = 10000
+
+//DNSCache 缓存域名解析结果，同一个域名同时只解析一次
+type DNSCache struct {
+	//解析成功的缓存时间
+	TTL time.Duration
+	//解析失败的缓存时间，默认5秒
+	NegativeTTL time.Duration
+	//每次解析的超时时间，默认10秒
+	//解析不使用调用者的ctx，一个调用者被取消不影响同时等待的其他调用者
+	Timeout time.Duration
+	//为nil时使用net.DefaultResolver
+	Resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+	//测试时替换
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dnsEntry struct {
+	//解析完成时关闭
+	done    chan struct{}
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+func NewDNSCache(ttl time.Duration) *DNSCache {
+	return &DNSCache{TTL: ttl, entries: make(map[string]*dnsEntry)}
+}
+
+//解析host，host是IP时直接返回
+func (c *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok {
+		select {
+		case <-e.done:
+			if time.Now().After(e.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		e = &dnsEntry{done: make(chan struct{})}
+		if len(c.entries) >= maxDNSEntries {
+			c.sweep()
+		}
+		c.entries[host] = e
+		c.mu.Unlock()
+		go c.resolve(host, e)
+	} else {
+		c.mu.Unlock()
+	}
+
+	select {
+	case <-e.done:
+		return e.addrs, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *DNSCache) resolve(host string, e *dnsEntry) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	lookup := c.lookup
+	if lookup == nil {
+		resolver := c.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		lookup = resolver.LookupIPAddr
+	}
+	e.addrs, e.err = lookup(ctx, host)
+
+	ttl := c.TTL
+	if e.err != nil {
+		ttl = c.NegativeTTL
+		if ttl <= 0 {
+			ttl = 5 * time.Second
+		}
+	}
+	e.expires = time.Now().Add(ttl)
+	close(e.done)
+}
+
+//删除过期的记录，需要持有锁
+func (c *DNSCache) sweep() {
+	now := time.Now()
+	for host, e := range c.entries {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				delete(c.entries, host)
+			}
+		default:
+		}
+	}
+}
+
+//清空缓存
+func (c *DNSCache) Clear() {
+	c.mu.Lock()
+	c.entries = make(map[string]*dnsEntry)
+	c.mu.Unlock()
+}
+
+//Dialer 使用DNS缓存，同时有IPv4和IPv6地址时按RFC 8305(happy eyeballs)连接
+type Dialer struct {
+	//每个地址的连接超时时间
+	Timeout   time.Duration
+	KeepAlive time.Duration
+	//默认300ms
+	FallbackDelay time.Duration
+	//为nil时每次都解析
+	DNS *DNSCache
+
+	//测试时替换
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IPAddr
+	if d.DNS != nil {
+		addrs, err = d.DNS.LookupIPAddr(ctx, host)
+	} else if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//第一个地址的类型优先，另一种作为备用
+	var primaries, fallbacks []string
+	var primaryV4 bool
+	for _, addr := range addrs {
+		v4 := addr.IP.To4() != nil
+		if (network == "tcp4" && !v4) || (network == "tcp6" && v4) {
+			continue
+		}
+		target := net.JoinHostPort(addr.String(), port)
+		if len(primaries) == 0 {
+			primaryV4 = v4
+		}
+		if primaryV4 == v4 {
+			primaries = append(primaries, target)
+		} else {
+			fallbacks = append(fallbacks, target)
+		}
+	}
+	if len(primaries) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, primaries)
+	}
+	return d.dialParallel(ctx, network, primaries, fallbacks)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+//先连接primaries，FallbackDelay之后或者primaries失败时同时连接fallbacks，使用先成功的连接
+func (d *Dialer) dialParallel(ctx context.Context, network string, primaries, fallbacks []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	start := func(addrs []string) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, addrs)
+			results <- dialResult{conn, err}
+		}()
+	}
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = 300 * time.Millisecond
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	start(primaries)
+	pending, fallback := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallback {
+				fallback = true
+				pending++
+				start(fallbacks)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				//另一个连接在取消前成功时关闭它
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallback {
+				fallback = true
+				pending++
+				start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+//依次连接每个地址
+func (d *Dialer) dialSerial(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	dial := d.dial
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: d.KeepAlive}).DialContext
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if d.Timeout > 0 {
+			dialCtx, cancel = context.WithTimeout(ctx, d.Timeout)
+		}
+		//连接成功后取消context不影响连接
+		conn, err := dial(dialCtx, network, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("requests: no address to dial")
+	}
+	return nil, firstErr
+}
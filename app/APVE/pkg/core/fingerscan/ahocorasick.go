@@ -0,0 +1,169 @@
+package fingerscan
+
+import "sort"
+
+// acMatcher is a byte-level Aho-Corasick automaton used to find, in a single
+// pass over a response, every rule literal it contains. It is read-only once
+// built and can be shared between goroutines.
+type acMatcher struct {
+	nodes    []acNode
+	root     [256]int32
+	patterns int
+	// dense holds precomputed transitions for nodes with many edges
+	dense [][256]int32
+	// report is, per node, the first node on its fail chain (itself
+	// included) with an output, or -1. It is kept apart from nodes so that
+	// the common "nothing to report" check stays in cache.
+	report []int32
+}
+
+type acNode struct {
+	edges []acEdge
+	// dense is an index into acMatcher.dense, or -1
+	dense int32
+	fail  int32
+	// output is the pattern ending at this node, or -1
+	output int32
+	// dict is the nearest node on the fail chain with an output, or -1
+	dict int32
+}
+
+type acEdge struct {
+	c    byte
+	next int32
+}
+
+// nodes with at least denseEdges children get a full transition table
+const denseEdges = 2
+
+func newACMatcher(patterns []string) *acMatcher {
+	m := &acMatcher{
+		nodes:    []acNode{newACNode()},
+		patterns: len(patterns),
+	}
+
+	for id, pattern := range patterns {
+		state := int32(0)
+		for i := 0; i < len(pattern); i++ {
+			next := m.edge(state, pattern[i])
+			if next < 0 {
+				next = int32(len(m.nodes))
+				m.nodes = append(m.nodes, newACNode())
+				m.addEdge(state, acEdge{c: pattern[i], next: next})
+			}
+			state = next
+		}
+		if m.nodes[state].output < 0 {
+			m.nodes[state].output = int32(id)
+		}
+	}
+
+	// breadth-first construction of fail and dictionary links
+	queue := make([]int32, 0, len(m.nodes))
+	for c := 0; c < 256; c++ {
+		next := m.edge(0, byte(c))
+		if next < 0 {
+			next = 0
+		} else {
+			// depth-one nodes fail back to the root
+			queue = append(queue, next)
+		}
+		m.root[c] = next
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, e := range m.nodes[state].edges {
+			fail := m.step(m.nodes[state].fail, e.c)
+			m.nodes[e.next].fail = fail
+			if m.nodes[fail].output >= 0 {
+				m.nodes[e.next].dict = fail
+			} else {
+				m.nodes[e.next].dict = m.nodes[fail].dict
+			}
+			queue = append(queue, e.next)
+		}
+	}
+
+	m.report = make([]int32, len(m.nodes))
+	for i := range m.nodes {
+		if m.nodes[i].output >= 0 {
+			m.report[i] = int32(i)
+		} else {
+			m.report[i] = m.nodes[i].dict
+		}
+	}
+
+	for i := 1; i < len(m.nodes); i++ {
+		if len(m.nodes[i].edges) < denseEdges {
+			continue
+		}
+		var row [256]int32
+		for c := 0; c < 256; c++ {
+			row[c] = m.step(int32(i), byte(c))
+		}
+		m.nodes[i].dense = int32(len(m.dense))
+		m.dense = append(m.dense, row)
+	}
+	return m
+}
+
+func newACNode() acNode {
+	return acNode{dense: -1, output: -1, dict: -1}
+}
+
+// addEdge inserts e keeping the edges of state sorted, which edge relies on.
+func (m *acMatcher) addEdge(state int32, e acEdge) {
+	edges := m.nodes[state].edges
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].c >= e.c })
+	edges = append(edges, acEdge{})
+	copy(edges[i+1:], edges[i:])
+	edges[i] = e
+	m.nodes[state].edges = edges
+}
+
+func (m *acMatcher) edge(state int32, c byte) int32 {
+	edges := m.nodes[state].edges
+	if len(edges) < 8 {
+		for _, e := range edges {
+			if e.c == c {
+				return e.next
+			}
+		}
+		return -1
+	}
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].c >= c })
+	if i < len(edges) && edges[i].c == c {
+		return edges[i].next
+	}
+	return -1
+}
+
+func (m *acMatcher) step(state int32, c byte) int32 {
+	for state != 0 {
+		if d := m.nodes[state].dense; d >= 0 {
+			return m.dense[d][c]
+		}
+		if next := m.edge(state, c); next >= 0 {
+			return next
+		}
+		state = m.nodes[state].fail
+	}
+	return m.root[c]
+}
+
+// scan marks in hits every pattern that occurs in text.
+func (m *acMatcher) scan(text string, hits []bool) {
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		state = m.step(state, text[i])
+		for out := m.report[state]; out > 0; out = m.nodes[out].dict {
+			id := m.nodes[out].output
+			if hits[id] {
+				// everything further down the chain was reported already
+				break
+			}
+			hits[id] = true
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package fingerscan
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBannerSize caps what is read from a service
+	maxBannerSize = 4 << 10
+	// bannerIdle ends a read once the service stopped sending for that long
+	bannerIdle = 300 * time.Millisecond
+)
+
+// bannerWait is how long a service gets to greet us before a probe is sent.
+// Variable for the tests.
+var bannerWait = 2 * time.Second
+
+// serviceProbes are the hellos of protocols where the client speaks first.
+// Anything else is given bannerWait to greet us, then genericProbe.
+var serviceProbes = map[string]string{
+	"http":      "GET / HTTP/1.0\r\n\r\n",
+	"redis":     "*1\r\n$4\r\nINFO\r\n",
+	"memcached": "version\r\n",
+	"rtsp":      "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n",
+}
+
+// genericProbe wakes up line based services waiting for input; HTTP servers
+// answer it with an error status. It fills a 5 byte TLS record header, so TLS
+// servers reject it at once rather than wait for the rest of the record.
+const genericProbe = "\r\n\r\n\r\n"
+
+// portProtocols guesses the protocol of a bare host:port.
+var portProtocols = func() map[string]string {
+	protocols := map[string]string{
+		"587":  "smtp",
+		"8000": "http",
+		"8080": "http",
+		"8081": "http",
+		"8888": "http",
+	}
+	for protocol, port := range defaultPorts {
+		protocols[port] = protocol
+	}
+	return protocols
+}()
+
+// isServiceTarget reports whether target is a TCP service rather than a web
+// page: host:port, or a url whose scheme is not http or https.
+func isServiceTarget(target string) bool {
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme != "http" && u.Scheme != "https"
+	}
+	_, _, err := net.SplitHostPort(target)
+	return err == nil
+}
+
+// parseService returns the address to dial for target and the protocol its
+// scheme or port suggests, "" when neither does.
+func parseService(target string) (string, string, error) {
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" && u.Host != "" {
+		scheme := strings.ToLower(u.Scheme)
+		port := u.Port()
+		if port == "" {
+			port = defaultPorts[scheme]
+		}
+		if port == "" {
+			return "", "", fmt.Errorf("%s: missing port", target)
+		}
+		hint := scheme
+		if scheme == "tcp" {
+			hint = portProtocols[port]
+		}
+		return net.JoinHostPort(u.Hostname(), port), hint, nil
+	}
+
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", err
+	}
+	return target, portProtocols[port], nil
+}
+
+// grabBanner connects to target and reads what the service says, sending the
+// probe of its protocol, or a generic one when it stays silent. A service
+// that does not answer that either is tried with a TLS handshake, and its
+// protocol is "tls" when it completes. A service that never answers is not an
+// error, its banner is just empty. The address dialed is returned along with
+// the response.
+func grabBanner(ctx context.Context, target string, timeout int) (Response, string, error) {
+	address, hint, err := parseService(target)
+	if err != nil {
+		return Response{}, "", err
+	}
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	if limiter := contextLimiter(ctx); limiter != nil {
+		done, err := limiter.Wait(ctx, address)
+		if err != nil {
+			return Response{}, "", err
+		}
+		defer done()
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(timeout))
+
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return Response{}, "", err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	var banner []byte
+	probe, clientFirst := serviceProbes[hint]
+	if !clientFirst {
+		wait := time.Now().Add(bannerWait)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		banner, err = readBanner(conn, wait)
+		probe = genericProbe
+	}
+	if len(banner) == 0 && err == nil && time.Now().Before(deadline) {
+		if err = conn.SetWriteDeadline(deadline); err == nil {
+			_, err = conn.Write([]byte(probe))
+		}
+		if err == nil {
+			banner, err = readBanner(conn, deadline)
+		}
+	}
+	if ctx.Err() != nil {
+		return Response{}, "", ctx.Err()
+	}
+	if err != nil && len(banner) == 0 {
+		return Response{}, "", err
+	}
+
+	protocol := detectProtocol(banner, hint)
+	if len(banner) == 0 && hint == "" && time.Now().Before(deadline) && speaksTLS(ctx, address, deadline) {
+		protocol = "tls"
+	}
+	return Response{
+		Url:      target,
+		Banner:   bannerText(banner),
+		Protocol: protocol,
+	}, address, nil
+}
+
+// speaksTLS reports whether a TLS handshake with address completes. Many TLS
+// servers close the connection on a plaintext probe without a word.
+func speaksTLS(ctx context.Context, address string, deadline time.Time) bool {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Deadline: deadline},
+		Config:    &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// readBanner reads until the service goes quiet, closes the connection, or
+// deadline. Neither of them is an error, even without any data.
+func readBanner(conn net.Conn, deadline time.Time) ([]byte, error) {
+	var banner []byte
+	buf := make([]byte, 1024)
+	for len(banner) < maxBannerSize {
+		readDeadline := deadline
+		if len(banner) > 0 {
+			if idle := time.Now().Add(bannerIdle); idle.Before(deadline) {
+				readDeadline = idle
+			}
+		}
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return banner, err
+		}
+
+		n, err := conn.Read(buf)
+		banner = append(banner, buf[:n]...)
+		if err != nil {
+			if isTimeout(err) || errors.Is(err, io.EOF) {
+				return banner, nil
+			}
+			return banner, err
+		}
+	}
+	if len(banner) > maxBannerSize {
+		banner = banner[:maxBannerSize]
+	}
+	return banner, nil
+}
+
+// bannerText makes a banner safe to print and match: printable ASCII, tabs
+// and line breaks are kept, other bytes are written as \xNN.
+func bannerText(banner []byte) string {
+	var b strings.Builder
+	for _, c := range banner {
+		if c >= 0x20 && c < 0x7f || c == '\r' || c == '\n' || c == '\t' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// detectProtocol names the protocol banner belongs to, falling back to hint.
+func detectProtocol(banner []byte, hint string) string {
+	upper := bytes.ToUpper(banner)
+	switch {
+	case len(banner) == 0:
+		return hint
+	case bytes.HasPrefix(banner, []byte("SSH-")):
+		return "ssh"
+	case bytes.HasPrefix(banner, []byte("HTTP/")):
+		return "http"
+	case bytes.HasPrefix(banner, []byte("RTSP/")):
+		return "rtsp"
+	case bytes.HasPrefix(banner, []byte("@RSYNCD:")):
+		return "rsync"
+	case bytes.HasPrefix(banner, []byte("RFB ")):
+		return "vnc"
+	case len(banner) >= 3 && (banner[0] == 0x15 || banner[0] == 0x16) && banner[1] == 0x03 && banner[2] <= 0x04:
+		// a TLS alert or handshake record answering the plaintext probe
+		return "tls"
+	case bytes.HasPrefix(banner, []byte("+PONG")), bytes.HasPrefix(banner, []byte("-NOAUTH")),
+		bytes.Contains(banner, []byte("redis_version:")), hint == "redis" && bytes.HasPrefix(banner, []byte("-ERR")):
+		return "redis"
+	case bytes.HasPrefix(banner, []byte("VERSION ")):
+		return "memcached"
+	case bytes.HasPrefix(banner, []byte("+OK")):
+		return "pop3"
+	case bytes.HasPrefix(banner, []byte("* OK")):
+		return "imap"
+	case bytes.HasPrefix(banner, []byte("220")):
+		switch {
+		case bytes.Contains(upper, []byte("SMTP")), bytes.Contains(upper, []byte("MAIL")):
+			return "smtp"
+		case bytes.Contains(upper, []byte("FTP")):
+			return "ftp"
+		case hint == "smtp":
+			return "smtp"
+		}
+		return "ftp"
+	case isMySQLGreeting(banner):
+		return "mysql"
+	case banner[0] == 0xff:
+		// telnet option negotiation starts with IAC
+		return "telnet"
+	}
+	return hint
+}
+
+// isMySQLGreeting recognizes the initial handshake packet of MySQL and
+// MariaDB, or the error packet sent to hosts that may not connect.
+func isMySQLGreeting(banner []byte) bool {
+	if len(banner) < 6 || banner[3] != 0 {
+		return false
+	}
+	if length := int(banner[0]) | int(banner[1])<<8 | int(banner[2])<<16; length < 2 {
+		return false
+	}
+	switch banner[4] {
+	case 0x0a:
+		// protocol 10, followed by a NUL terminated server version
+		return bytes.IndexByte(banner[5:], 0) > 0
+	case 0xff:
+		return bytes.Contains(banner, []byte("MySQL")) || bytes.Contains(banner, []byte("MariaDB"))
+	}
+	return false
+}
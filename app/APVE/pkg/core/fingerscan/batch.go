@@ -0,0 +1,264 @@
+package fingerscan
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"heaven/app/APVE/pkg/common/requests"
+)
+
+// BatchOptions tunes a batch scan. Zero values select the defaults.
+type BatchOptions struct {
+	// Workers is the number of targets scanned at the same time
+	Workers int
+	// PerHost caps the concurrent requests against a single host:port,
+	// redirects, favicons and path probes included
+	PerHost int
+	// RateLimit caps the requests per second over the whole batch, every
+	// request of a target counted, 0 means unlimited
+	RateLimit float64
+	// Timeout is the per-request timeout in seconds
+	Timeout int
+	// Buffer is the capacity of the result channel
+	Buffer int
+}
+
+const (
+	defaultBatchWorkers = 50
+	defaultBatchPerHost = 2
+	defaultBatchTimeout = 10
+)
+
+func (opts *BatchOptions) setDefaults() {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultBatchWorkers
+	}
+	if opts.PerHost <= 0 {
+		opts.PerHost = defaultBatchPerHost
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultBatchTimeout
+	}
+	if opts.Buffer < 0 {
+		opts.Buffer = 0
+	}
+}
+
+// BatchResult is the outcome of one target. Err is set when the target could
+// not be fingerprinted.
+type BatchResult struct {
+	Results
+	Err error
+}
+
+// BatchSummary counts the outcome of a finished batch.
+type BatchSummary struct {
+	// Total is the number of targets received, duplicates included
+	Total      int
+	Done       int
+	Failed     int
+	Timeouts   int
+	Duplicates int
+	// Canceled is the number of targets dropped because the context ended
+	Canceled int
+	Elapsed  time.Duration
+}
+
+// Batch is a running batch scan. Results must be drained until it is closed,
+// or ctx canceled, after which Wait returns the summary.
+type Batch struct {
+	results chan BatchResult
+	done    chan struct{}
+
+	mu      sync.Mutex
+	summary BatchSummary
+}
+
+// Results streams the results in completion order. The channel is closed
+// once every target has been handled.
+func (b *Batch) Results() <-chan BatchResult {
+	return b.results
+}
+
+// Wait blocks until the batch is finished and returns its summary.
+func (b *Batch) Wait() BatchSummary {
+	<-b.done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.summary
+}
+
+func (b *Batch) count(f func(summary *BatchSummary)) {
+	b.mu.Lock()
+	f(&b.summary)
+	b.mu.Unlock()
+}
+
+// ScanBatch fingerprints targets concurrently, see ScanStream.
+func (e *FingerprintEngine) ScanBatch(ctx context.Context, targets []string, opts BatchOptions) *Batch {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		for _, target := range targets {
+			select {
+			case ch <- target:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return e.ScanStream(ctx, ch, opts)
+}
+
+// ScanStream fingerprints the targets read from targets until it is closed or
+// ctx is done, web pages and TCP services alike, see ScanTarget. Duplicate
+// targets are scanned only once.
+func (e *FingerprintEngine) ScanStream(ctx context.Context, targets <-chan string, opts BatchOptions) *Batch {
+	opts.setDefaults()
+	b := &Batch{
+		results: make(chan BatchResult, opts.Buffer),
+		done:    make(chan struct{}),
+	}
+
+	var (
+		start = time.Now()
+		jobs  = make(chan string)
+		wg    sync.WaitGroup
+	)
+	// every fetch and banner grab of the batch goes through the limiter
+	limiter := requests.NewLimiter(requests.Limit{Rate: opts.RateLimit}, requests.Limit{MaxInFlight: opts.PerHost})
+	scanCtx := withLimiter(ctx, limiter)
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				result, ok := e.scanTarget(scanCtx, target, opts.Timeout)
+				if !ok {
+					b.count(func(s *BatchSummary) { s.Canceled++ })
+					continue
+				}
+				// the consumer may stop reading once it canceled ctx
+				select {
+				case b.results <- result:
+				case <-ctx.Done():
+					b.count(func(s *BatchSummary) { s.Canceled++ })
+					continue
+				}
+				b.count(func(s *BatchSummary) {
+					switch {
+					case result.Err == nil:
+						s.Done++
+					case isTimeout(result.Err):
+						s.Timeouts++
+					default:
+						s.Failed++
+					}
+				})
+			}
+		}()
+	}
+
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			b.count(func(s *BatchSummary) { s.Elapsed = time.Since(start) })
+			close(b.results)
+			close(b.done)
+		}()
+
+		seen := make(map[string]bool)
+		for {
+			var (
+				target string
+				ok     bool
+			)
+			select {
+			case target, ok = <-targets:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			b.count(func(s *BatchSummary) { s.Total++ })
+			key := normalizeTarget(target)
+			if seen[key] {
+				b.count(func(s *BatchSummary) { s.Duplicates++ })
+				continue
+			}
+			seen[key] = true
+
+			select {
+			case jobs <- target:
+			case <-ctx.Done():
+				b.count(func(s *BatchSummary) { s.Canceled++ })
+				return
+			}
+		}
+	}()
+
+	return b
+}
+
+// scanTarget returns false when ctx ended before the target was scanned.
+func (e *FingerprintEngine) scanTarget(ctx context.Context, target string, timeout int) (BatchResult, bool) {
+	results, err := e.ScanTarget(ctx, target, timeout)
+	if err != nil && ctx.Err() != nil {
+		return BatchResult{}, false
+	}
+	if err != nil {
+		results.Url = target
+	}
+	return BatchResult{Results: results, Err: err}, true
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// normalizeTarget maps equivalent urls to the same key for deduplication.
+func normalizeTarget(target string) string {
+	target = strings.TrimSpace(target)
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(target)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	key := scheme + "://" + net.JoinHostPort(host, port) + path
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
+
+type limiterKey struct{}
+
+// withLimiter makes every request made with ctx wait for limiter.
+func withLimiter(ctx context.Context, limiter *requests.Limiter) context.Context {
+	return context.WithValue(ctx, limiterKey{}, limiter)
+}
+
+func contextLimiter(ctx context.Context) *requests.Limiter {
+	limiter, _ := ctx.Value(limiterKey{}).(*requests.Limiter)
+	return limiter
+}
@@ -0,0 +1,331 @@
+package fingerscan
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FingerprintEngine is a compiled fingerprint database. It is built once and
+// is read-only afterwards, so one engine can be shared by any number of
+// goroutines.
+//
+// Every literal of every rule goes into a single Aho-Corasick automaton. A
+// response is scanned once, and only fingerprints that can still match given
+// the literals found in it are evaluated.
+type FingerprintEngine struct {
+	fingerprints []*fingerprint
+	matcher      *acMatcher
+	// candidates lists, per pattern, the fingerprints that use it
+	candidates [][]int
+	// always lists fingerprints that may match without any literal present
+	always []int
+	// probes lists fingerprints with path hashes
+	probes []int
+	// icons is set when some rule needs the favicon of the target
+	icons bool
+	// transport replaces scanTransport when set, see WithTransport
+	transport http.RoundTripper
+}
+
+// NewFingerprintEngine compiles fingerArgs. Fingerprints whose keys do not
+// parse are skipped and reported through RuleErrors, the returned engine is
+// still usable.
+func NewFingerprintEngine(fingerArgs []FingerArg) (*FingerprintEngine, error) {
+	fingerprints, err := compileFingerprints(fingerArgs)
+	return newFingerprintEngine(fingerprints), err
+}
+
+// LoadFingerprintEngine reads a fingerprint database file and compiles it.
+func LoadFingerprintEngine(name string) (*FingerprintEngine, error) {
+	fingerprints, err := initFingerprintFile(name)
+	if fingerprints == nil {
+		return nil, err
+	}
+	return newFingerprintEngine(fingerprints), err
+}
+
+func newFingerprintEngine(fingerprints []*fingerprint) *FingerprintEngine {
+	e := &FingerprintEngine{fingerprints: fingerprints}
+
+	var patterns []string
+	ids := make(map[string]int)
+	for i, finger := range fingerprints {
+		if hasProbe(finger) {
+			e.probes = append(e.probes, i)
+		}
+		if usesField(finger.rule, iconFields) {
+			e.icons = true
+		}
+		if !needsLiteral(finger.rule) {
+			e.always = append(e.always, i)
+			continue
+		}
+
+		seen := make(map[int]bool)
+		for _, literal := range ruleLiterals(finger.rule, nil) {
+			id, ok := ids[literal]
+			if !ok {
+				id = len(patterns)
+				ids[literal] = id
+				patterns = append(patterns, literal)
+				e.candidates = append(e.candidates, nil)
+			}
+			if !seen[id] {
+				seen[id] = true
+				e.candidates[id] = append(e.candidates[id], i)
+			}
+		}
+	}
+
+	e.matcher = newACMatcher(patterns)
+	return e
+}
+
+// WithTransport returns a copy of e that fetches pages and probes through
+// transport, e.g. a requests.HARReplay to test fingerprints against recorded
+// traffic offline. The copy shares the compiled database with e.
+func (e *FingerprintEngine) WithTransport(transport http.RoundTripper) *FingerprintEngine {
+	c := *e
+	c.transport = transport
+	return &c
+}
+
+// context carries the transport of e to the fetches made with ctx.
+func (e *FingerprintEngine) context(ctx context.Context) context.Context {
+	if e.transport == nil {
+		return ctx
+	}
+	return withTransport(ctx, e.transport)
+}
+
+// Len returns the number of compiled fingerprints.
+func (e *FingerprintEngine) Len() int {
+	return len(e.fingerprints)
+}
+
+// Scan fetches url and identifies the response. timeout is in seconds and
+// also applies to the favicon and path probes.
+func (e *FingerprintEngine) Scan(ctx context.Context, url string, timeout int) (Results, error) {
+	ctx = e.context(ctx)
+	start := time.Now()
+	response, err := sendRequest(ctx, url, timeout)
+	if err != nil {
+		return Results{}, err
+	}
+	fetched := time.Now()
+
+	results := e.identify(response, newProbeCache(ctx, url, timeout))
+	results.ScannedAt = start
+	results.FetchTime = fetched.Sub(start)
+	results.MatchTime = time.Since(fetched)
+	return results, nil
+}
+
+// ScanService grabs the banner of a TCP service and identifies it. target is
+// host:port or scheme://host[:port], the scheme naming the protocol to probe
+// with; "tcp" leaves it to the port. Services that turn out to speak HTTP
+// are scanned as web pages, over https when the port suggests it or the
+// service speaks TLS.
+func (e *FingerprintEngine) ScanService(ctx context.Context, target string, timeout int) (Results, error) {
+	ctx = e.context(ctx)
+	start := time.Now()
+	scanWeb := func(url string) (Results, error) {
+		results, err := e.Scan(ctx, url, timeout)
+		results.Url = target
+		results.ScannedAt = start
+		return results, err
+	}
+	address, hint, err := parseService(target)
+	if err != nil {
+		return Results{}, err
+	}
+	if hint == "https" {
+		// a plaintext probe would only get a TLS alert
+		return scanWeb("https://" + address)
+	}
+
+	response, address, err := grabBanner(ctx, target, timeout)
+	if err != nil {
+		return Results{}, err
+	}
+	switch response.Protocol {
+	case "http":
+		return scanWeb("http://" + address)
+	case "tls":
+		// not every TLS service is a web server, the banner scan stands then
+		if results, err := scanWeb("https://" + address); err == nil {
+			return results, nil
+		}
+	}
+	fetched := time.Now()
+
+	results := e.identify(response, newProbeCache(ctx, target, timeout))
+	results.ScannedAt = start
+	results.FetchTime = fetched.Sub(start)
+	results.MatchTime = time.Since(fetched)
+	return results, nil
+}
+
+// ScanTarget scans target with ScanService when it is a TCP service, see
+// isServiceTarget, and with Scan otherwise.
+func (e *FingerprintEngine) ScanTarget(ctx context.Context, target string, timeout int) (Results, error) {
+	if isServiceTarget(target) {
+		return e.ScanService(ctx, target, timeout)
+	}
+	return e.Scan(ctx, target, timeout)
+}
+
+// Identify matches response against the database. Favicons and path hashes
+// are fetched relative to response.Url; a probe that fails only means the
+// fingerprints depending on it do not match.
+func (e *FingerprintEngine) Identify(response Response) (Results, error) {
+	start := time.Now()
+	results := e.identify(response, newProbeCache(e.context(context.Background()), response.Url, defaultProbeTimeout))
+	results.ScannedAt = start
+	results.MatchTime = time.Since(start)
+	return results, nil
+}
+
+func (e *FingerprintEngine) identify(response Response, probes *probeCache) Results {
+	results := Results{
+		Url:           response.Url,
+		FinalUrl:      response.FinalUrl,
+		StatusCode:    response.StateCode,
+		Title:         response.Title,
+		Server:        response.Header.Get("Server"),
+		ContentLength: response.ContentLength,
+		Charset:       response.Charset,
+		Banner:        response.Banner,
+		FingerPrint:   []string{},
+	}
+	if results.ContentLength == 0 {
+		results.ContentLength = int64(len(response.Body))
+	}
+	page := response.FinalUrl
+	if page == "" {
+		page = response.Url
+	}
+
+	t := newTarget(response)
+	results.Protocol = t.text["protocol"]
+	if e.icons && isWebTarget(t) {
+		mmh3s, md5s := probes.favicons(page, response.Body)
+		t.setValues("icon_hash", mmh3s)
+		t.setValues("icon_md5", md5s)
+	}
+
+	add := func(finger *fingerprint, t *target, rule, evidence string) {
+		results.FingerPrint = append(results.FingerPrint, finger.Name)
+		results.Matches = append(results.Matches, Match{
+			Id:       finger.Id,
+			Name:     finger.Name,
+			Version:  extractVersion(finger, t, probes),
+			Rule:     rule,
+			Evidence: evidence,
+		})
+	}
+
+	matched := make([]bool, len(e.fingerprints))
+	targets := []*target{t}
+	if response.Landing != nil {
+		targets = append(targets, newTarget(*response.Landing))
+	}
+	for _, t := range targets {
+		for _, i := range e.candidateSet(t) {
+			finger := e.fingerprints[i]
+			if !matched[i] && finger.rule.match(t) {
+				matched[i] = true
+				add(finger, t, finger.Key, evidence(evidenceCond(finger.rule, t), t))
+			}
+		}
+	}
+
+	if !isWebTarget(t) {
+		return results
+	}
+	for _, i := range e.probes {
+		if matched[i] {
+			continue
+		}
+		if hash, ok := matchPathHash(probes, e.fingerprints[i]); ok {
+			add(e.fingerprints[i], t, "path="+hash.Url, fmt.Sprintf("md5(%s): %s", hash.Url, hash.Hash))
+		}
+	}
+	return results
+}
+
+func isWebTarget(t *target) bool {
+	return t.text["type"] == "subdomain"
+}
+
+var hitsPool = sync.Pool{New: func() interface{} { return new([]bool) }}
+
+// candidateSet returns, in database order, the fingerprints worth evaluating
+// against t.
+func (e *FingerprintEngine) candidateSet(t *target) []int {
+	hp := hitsPool.Get().(*[]bool)
+	defer hitsPool.Put(hp)
+	if cap(*hp) < e.matcher.patterns {
+		*hp = make([]bool, e.matcher.patterns)
+	}
+	hits := (*hp)[:e.matcher.patterns]
+	for i := range hits {
+		hits[i] = false
+	}
+
+	for _, text := range t.text {
+		e.matcher.scan(text, hits)
+	}
+
+	selected := make([]bool, len(e.fingerprints))
+	for _, i := range e.always {
+		selected[i] = true
+	}
+	for id, hit := range hits {
+		if hit {
+			for _, i := range e.candidates[id] {
+				selected[i] = true
+			}
+		}
+	}
+
+	var candidates []int
+	for i, ok := range selected {
+		if ok {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+// needsLiteral reports whether node can only be true when at least one of its
+// positive literals occurs somewhere in the response.
+func needsLiteral(node ruleNode) bool {
+	switch n := node.(type) {
+	case *condNode:
+		return n.op != opNotContains && n.lower != ""
+	case *andNode:
+		return needsLiteral(n.left) || needsLiteral(n.right)
+	case *orNode:
+		return needsLiteral(n.left) && needsLiteral(n.right)
+	}
+	return false
+}
+
+// ruleLiterals collects the lower-cased values of the positive conditions.
+func ruleLiterals(node ruleNode, literals []string) []string {
+	switch n := node.(type) {
+	case *condNode:
+		if n.op != opNotContains && n.lower != "" {
+			literals = append(literals, n.lower)
+		}
+	case *andNode:
+		literals = ruleLiterals(n.right, ruleLiterals(n.left, literals))
+	case *orNode:
+		literals = ruleLiterals(n.right, ruleLiterals(n.left, literals))
+	}
+	return literals
+}
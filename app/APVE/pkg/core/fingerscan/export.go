@@ -0,0 +1,154 @@
+package fingerscan
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResultWriter exports scan results. Writers are not safe for concurrent use;
+// drain a Batch from a single goroutine and write from there.
+type ResultWriter interface {
+	Write(results Results) error
+	// Flush writes any buffered data to the underlying writer
+	Flush() error
+}
+
+// resultRecord is the exported form of Results, shared by every format.
+type resultRecord struct {
+	Url           string        `json:"url"`
+	FinalUrl      string        `json:"final_url,omitempty"`
+	StatusCode    int           `json:"status_code"`
+	Title         string        `json:"title"`
+	Server        string        `json:"server,omitempty"`
+	ContentLength int64         `json:"content_length"`
+	Charset       string        `json:"charset,omitempty"`
+	Protocol      string        `json:"protocol,omitempty"`
+	Banner        string        `json:"banner,omitempty"`
+	Fingerprints  []string      `json:"fingerprints"`
+	Matches       []matchRecord `json:"matches"`
+	ScannedAt     string        `json:"scanned_at,omitempty"`
+	FetchMs       float64       `json:"fetch_ms"`
+	MatchMs       float64       `json:"match_ms"`
+}
+
+type matchRecord struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+	Rule     string `json:"rule"`
+	Evidence string `json:"evidence,omitempty"`
+}
+
+func newResultRecord(results Results) resultRecord {
+	record := resultRecord{
+		Url:           results.Url,
+		FinalUrl:      results.FinalUrl,
+		StatusCode:    results.StatusCode,
+		Title:         results.Title,
+		Server:        results.Server,
+		ContentLength: results.ContentLength,
+		Charset:       results.Charset,
+		Protocol:      results.Protocol,
+		Banner:        results.Banner,
+		Fingerprints:  results.FingerPrint,
+		Matches:       make([]matchRecord, 0, len(results.Matches)),
+		FetchMs:       milliseconds(results.FetchTime),
+		MatchMs:       milliseconds(results.MatchTime),
+	}
+	if record.Fingerprints == nil {
+		record.Fingerprints = []string{}
+	}
+	if !results.ScannedAt.IsZero() {
+		record.ScannedAt = results.ScannedAt.UTC().Format(time.RFC3339Nano)
+	}
+	for _, m := range results.Matches {
+		record.Matches = append(record.Matches, matchRecord(m))
+	}
+	return record
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+// NewJSONLinesWriter writes one JSON object per result and line.
+func NewJSONLinesWriter(w io.Writer) ResultWriter {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &jsonLinesWriter{encoder: encoder}
+}
+
+func (w *jsonLinesWriter) Write(results Results) error {
+	return w.encoder.Encode(newResultRecord(results))
+}
+
+func (w *jsonLinesWriter) Flush() error {
+	return nil
+}
+
+var csvHeader = []string{
+	"url", "final_url", "status_code", "title", "server", "content_length", "charset", "protocol", "banner",
+	"scanned_at", "fetch_ms", "match_ms",
+	"id", "name", "version", "rule", "evidence",
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+// NewCSVWriter writes a header line, then one line per match. Results
+// without any match still get a line, with empty match columns, so that
+// every scanned url is in the output.
+func NewCSVWriter(w io.Writer) ResultWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (w *csvWriter) Write(results Results) error {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if err := w.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	r := newResultRecord(results)
+	row := []string{
+		csvText(r.Url), csvText(r.FinalUrl), strconv.Itoa(r.StatusCode), csvText(r.Title), csvText(r.Server),
+		strconv.FormatInt(r.ContentLength, 10), csvText(r.Charset), csvText(r.Protocol), csvText(r.Banner), r.ScannedAt,
+		strconv.FormatFloat(r.FetchMs, 'f', -1, 64), strconv.FormatFloat(r.MatchMs, 'f', -1, 64),
+	}
+	if len(r.Matches) == 0 {
+		return w.w.Write(append(row, "", "", "", "", ""))
+	}
+	for _, m := range r.Matches {
+		line := append(row[:len(row):len(row)],
+			strconv.Itoa(m.Id), csvText(m.Name), csvText(m.Version), csvText(m.Rule), csvText(m.Evidence))
+		if err := w.w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// csvText defuses values a spreadsheet would run as a formula. Titles and
+// evidence come from the scanned hosts and cannot be trusted.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
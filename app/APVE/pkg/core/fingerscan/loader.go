@@ -0,0 +1,672 @@
+package fingerscan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fingerprint database formats understood by LoadFingerArgs.
+const (
+	FormatNative     = "native"
+	FormatEHole      = "ehole"
+	FormatWappalyzer = "wappalyzer"
+)
+
+// LoadReport describes what LoadFingerArgs read and every fix it had to make,
+// so that merged databases can be reviewed before they are saved.
+type LoadReport struct {
+	Files []string
+	// Imported counts the fingerprints read per format, before deduplication
+	Imported map[string]int
+	// Loaded is the number of valid fingerprints returned
+	Loaded int
+	// Duplicates are fingerprints dropped because an earlier one has the
+	// same name and rule
+	Duplicates []LoadIssue
+	// Conflicts are fingerprints kept although an earlier one has the same
+	// name, because their rules differ
+	Conflicts []LoadIssue
+	// IdCollisions are fingerprints that were given a new id
+	IdCollisions []LoadIssue
+	// Skipped are entries that cannot be expressed as a fingerprint
+	Skipped []LoadIssue
+	// Invalid are fingerprints whose rules do not compile
+	Invalid RuleErrors
+	// Unknown are files of a directory that hold none of the known formats
+	// and were left out
+	Unknown []string
+}
+
+// LoadIssue is one entry of a LoadReport.
+type LoadIssue struct {
+	File   string
+	Id     int
+	Name   string
+	Detail string
+}
+
+func (i LoadIssue) String() string {
+	return fmt.Sprintf("%s: %s (id %d): %s", i.File, i.Name, i.Id, i.Detail)
+}
+
+// String renders the report, one issue per line.
+func (r *LoadReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "loaded %d fingerprints from %d files", r.Loaded, len(r.Files))
+	formats := make([]string, 0, len(r.Imported))
+	for format := range r.Imported {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		fmt.Fprintf(&b, ", %d %s", r.Imported[format], format)
+	}
+	b.WriteString("\n")
+
+	for _, issues := range []struct {
+		kind   string
+		issues []LoadIssue
+	}{
+		{"duplicate", r.Duplicates},
+		{"name conflict", r.Conflicts},
+		{"id collision", r.IdCollisions},
+		{"skipped", r.Skipped},
+	} {
+		for _, issue := range issues.issues {
+			fmt.Fprintf(&b, "%s: %s\n", issues.kind, issue)
+		}
+	}
+	for _, err := range r.Invalid {
+		fmt.Fprintf(&b, "invalid: %s\n", err)
+	}
+	for _, file := range r.Unknown {
+		fmt.Fprintf(&b, "unknown format: %s\n", file)
+	}
+	return b.String()
+}
+
+// LoadFingerArgs reads a fingerprint file, or every .json, .yaml and .yml file
+// under a directory, and merges them into one database. Files may hold the
+// native format, EHole finger.json or Wappalyzer technologies, in JSON or
+// YAML.
+//
+// Fingerprints with the same name and rule are kept once, while ones that
+// share a name but not a rule are all kept and listed as conflicts to review.
+// Colliding or missing ids are renumbered after the highest id, and
+// fingerprints whose rule does not compile are left out. All of it is listed
+// in the report, as are files of a directory in none of these formats. The
+// error is only set when a file cannot be read or decoded, or path itself is
+// not in a known format.
+func LoadFingerArgs(path string) ([]FingerArg, *LoadReport, error) {
+	fingerprints, report, err := loadFingerprints(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := make([]FingerArg, 0, len(fingerprints))
+	for _, finger := range fingerprints {
+		args = append(args, finger.FingerArg)
+	}
+	return args, report, nil
+}
+
+// WriteFingerArgs writes args in the native format, as Hfinger.json is.
+func WriteFingerArgs(w io.Writer, args []FingerArg) error {
+	out := make([]FingerArg, len(args))
+	for i, arg := range args {
+		if arg.Path == nil {
+			arg.Path = []UrlHash{}
+		}
+		out[i] = arg
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(out)
+}
+
+func loadFingerprints(path string) ([]*fingerprint, *LoadReport, error) {
+	files, err := fingerFiles(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := &LoadReport{Files: files, Imported: make(map[string]int)}
+	var sources []fingerSource
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		args, format, skipped, err := parseFingerFile(file, data)
+		if err == errUnknownFormat && file != path {
+			report.Unknown = append(report.Unknown, file)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", file, err)
+		}
+		report.Imported[format] += len(args)
+		report.Skipped = append(report.Skipped, skipped...)
+		sources = append(sources, fingerSource{file: file, args: args})
+	}
+
+	fingerprints, err := compileFingerprints(mergeFingerArgs(sources, report))
+	if ruleErrs, ok := err.(RuleErrors); ok {
+		report.Invalid = ruleErrs
+	}
+	report.Loaded = len(fingerprints)
+	return fingerprints, report, nil
+}
+
+// fingerFiles lists path itself, or the rule files under it in lexical order.
+func fingerFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json", ".yaml", ".yml":
+			if !info.IsDir() {
+				files = append(files, name)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+var errUnknownFormat = errors.New("unknown fingerprint format")
+
+// wappalyzerKeys are the fields of a Wappalyzer technology. An object counts
+// as a technology when it has any of them.
+var wappalyzerKeys = map[string]bool{
+	"cats": true, "website": true, "description": true, "icon": true, "cpe": true,
+	"implies": true, "requires": true, "excludes": true, "saas": true, "oss": true, "pricing": true,
+	"headers": true, "cookies": true, "html": true, "css": true, "dom": true, "meta": true,
+	"scriptSrc": true, "scripts": true, "js": true, "url": true, "xhr": true, "dns": true,
+	"robots": true, "certIssuer": true, "probe": true,
+}
+
+// isWappalyzer reports whether every value of doc looks like a Wappalyzer
+// technology.
+func isWappalyzer(doc map[string]json.RawMessage) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for _, raw := range doc {
+		var tech map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &tech); err != nil {
+			return false
+		}
+		known := false
+		for key := range tech {
+			if wappalyzerKeys[key] {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFingerFile decodes one file and converts it to FingerArgs, guessing
+// the format from its top-level layout. It returns errUnknownFormat for an
+// object that is neither EHole nor Wappalyzer.
+func parseFingerFile(name string, data []byte) ([]FingerArg, string, []LoadIssue, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, "", nil, err
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || string(data) == "null" {
+		return nil, FormatNative, nil, nil
+	}
+	if data[0] == '[' {
+		var args []FingerArg
+		err := json.Unmarshal(data, &args)
+		return args, FormatNative, nil, err
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, "", nil, err
+	}
+	if raw, ok := doc["fingerprint"]; ok {
+		args, skipped, err := importEHole(name, raw)
+		return args, FormatEHole, skipped, err
+	}
+	if raw, ok := doc["technologies"]; ok {
+		data = raw
+	} else if !isWappalyzer(doc) {
+		return nil, "", nil, errUnknownFormat
+	}
+	args, skipped, err := importWappalyzer(name, data)
+	return args, FormatWappalyzer, skipped, err
+}
+
+type fingerSource struct {
+	file string
+	args []FingerArg
+}
+
+// mergeFingerArgs drops duplicates, reports name conflicts and gives every
+// fingerprint a unique id, keeping the ids of the first fingerprint that
+// claims them.
+func mergeFingerArgs(sources []fingerSource, report *LoadReport) []FingerArg {
+	var merged []FingerArg
+	var files []string
+	// duplicates and conflicts are reported once the ids they refer to are
+	// final
+	var duplicates []int
+	var conflicts [][2]int
+	seen := make(map[string]int)
+	names := make(map[string]int)
+	ids := make(map[int]int)
+	maxId := 0
+	for _, source := range sources {
+		for _, arg := range source.args {
+			key := dedupeKey(arg)
+			if first, ok := seen[key]; ok {
+				report.Duplicates = append(report.Duplicates, LoadIssue{File: source.file, Id: arg.Id, Name: arg.Name})
+				duplicates = append(duplicates, first)
+				continue
+			}
+			seen[key] = len(merged)
+			name := strings.ToLower(strings.TrimSpace(arg.Name))
+			if first, ok := names[name]; ok {
+				report.Conflicts = append(report.Conflicts, LoadIssue{File: source.file, Name: arg.Name})
+				conflicts = append(conflicts, [2]int{len(merged), first})
+			} else {
+				names[name] = len(merged)
+			}
+
+			if arg.Id > 0 {
+				if _, ok := ids[arg.Id]; !ok {
+					ids[arg.Id] = len(merged)
+				}
+				if arg.Id > maxId {
+					maxId = arg.Id
+				}
+			}
+			merged = append(merged, arg)
+			files = append(files, source.file)
+		}
+	}
+
+	for i := range merged {
+		arg := &merged[i]
+		if arg.Id > 0 && ids[arg.Id] == i {
+			continue
+		}
+		maxId++
+		if arg.Id > 0 {
+			report.IdCollisions = append(report.IdCollisions, LoadIssue{
+				File:   files[i],
+				Id:     arg.Id,
+				Name:   arg.Name,
+				Detail: fmt.Sprintf("id taken by %s, renumbered to %d", merged[ids[arg.Id]].Name, maxId),
+			})
+		}
+		arg.Id = maxId
+	}
+
+	for i, first := range duplicates {
+		report.Duplicates[i].Detail = fmt.Sprintf("same rule as id %d in %s", merged[first].Id, files[first])
+	}
+	for i, pair := range conflicts {
+		first := merged[pair[1]]
+		report.Conflicts[i].Id = merged[pair[0]].Id
+		report.Conflicts[i].Detail = fmt.Sprintf("same name as id %d in %s, both kept", first.Id, files[pair[1]])
+	}
+	return merged
+}
+
+// dedupeKey identifies fingerprints that detect the same product the same
+// way, whatever the spacing and case of their rules.
+func dedupeKey(arg FingerArg) string {
+	key := strings.TrimSpace(arg.Key)
+	if rule, err := parseRule(arg.Key); err == nil {
+		key = rule.String()
+	}
+	return strings.ToLower(strings.TrimSpace(arg.Name)) + "\x00" + strings.ToLower(key)
+}
+
+// quoteRule builds a condition, escaping quotes the way parseValue reads them.
+func quoteRule(field, value string) string {
+	return field + `="` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+func joinRules(rules []string, op string) string {
+	return strings.Join(rules, " "+op+" ")
+}
+
+// groupRules joins rules for use as an operand of another operator.
+func groupRules(rules []string, op string) string {
+	if len(rules) == 1 {
+		return rules[0]
+	}
+	return "(" + joinRules(rules, op) + ")"
+}
+
+// eholeFinger is one entry of the EHole finger.json.
+type eholeFinger struct {
+	Cms      string   `json:"cms"`
+	Method   string   `json:"method"`
+	Location string   `json:"location"`
+	Keyword  []string `json:"keyword"`
+}
+
+// importEHole converts EHole fingerprints. Keywords must all match, except
+// favicon hashes where any of them does; regular expressions have no
+// equivalent in the rule language and are skipped.
+func importEHole(name string, data []byte) ([]FingerArg, []LoadIssue, error) {
+	var fingers []eholeFinger
+	if err := json.Unmarshal(data, &fingers); err != nil {
+		return nil, nil, err
+	}
+
+	var args []FingerArg
+	var skipped []LoadIssue
+	for _, finger := range fingers {
+		skip := func(detail string) {
+			skipped = append(skipped, LoadIssue{File: name, Name: finger.Cms, Detail: detail})
+		}
+		if len(finger.Keyword) == 0 {
+			skip("no keyword")
+			continue
+		}
+
+		var rules []string
+		op := "&&"
+		switch strings.ToLower(finger.Method) {
+		case "keyword":
+			field := strings.ToLower(finger.Location)
+			if field != "body" && field != "header" && field != "title" {
+				skip(fmt.Sprintf("unsupported location %q", finger.Location))
+				continue
+			}
+			for _, keyword := range finger.Keyword {
+				rules = append(rules, quoteRule(field, keyword))
+			}
+		case "faviconhash":
+			op = "||"
+			for _, keyword := range finger.Keyword {
+				rules = append(rules, quoteRule("icon_hash", keyword))
+			}
+		default:
+			skip(fmt.Sprintf("unsupported method %q", finger.Method))
+			continue
+		}
+		args = append(args, FingerArg{Name: finger.Cms, Key: joinRules(rules, op)})
+	}
+	return args, skipped, nil
+}
+
+// wappalyzerTech is the part of a Wappalyzer technology that can be checked
+// against a single response.
+type wappalyzerTech struct {
+	Headers   map[string]string     `json:"headers"`
+	Cookies   map[string]string     `json:"cookies"`
+	HTML      stringList            `json:"html"`
+	ScriptSrc stringList            `json:"scriptSrc"`
+	Scripts   stringList            `json:"scripts"`
+	Meta      map[string]stringList `json:"meta"`
+}
+
+// stringList accepts a string where a list of strings is expected.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*l = list
+	return err
+}
+
+// importWappalyzer converts Wappalyzer technologies. Patterns are regular
+// expressions, so only their literal parts become rule conditions; the
+// expressions themselves are kept as version extractors when they carry a
+// version tag.
+func importWappalyzer(name string, data []byte) ([]FingerArg, []LoadIssue, error) {
+	var techs map[string]wappalyzerTech
+	if err := json.Unmarshal(data, &techs); err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(techs))
+	for tech := range techs {
+		names = append(names, tech)
+	}
+	sort.Strings(names)
+
+	var args []FingerArg
+	var skipped []LoadIssue
+	for _, tech := range names {
+		var c wappalyzerConverter
+		t := techs[tech]
+		for _, header := range sortedKeys(t.Headers) {
+			c.header(header, t.Headers[header])
+		}
+		for _, cookie := range sortedKeys(t.Cookies) {
+			c.rule(quoteRule("header", "set-cookie: "+strings.ToLower(cookie)+"="))
+		}
+		for _, pattern := range t.HTML {
+			c.body(pattern)
+		}
+		for _, pattern := range append(t.ScriptSrc, t.Scripts...) {
+			c.body(pattern)
+		}
+		metas := make([]string, 0, len(t.Meta))
+		for meta := range t.Meta {
+			metas = append(metas, meta)
+		}
+		sort.Strings(metas)
+		for _, meta := range metas {
+			for _, pattern := range t.Meta[meta] {
+				c.meta(meta, pattern)
+			}
+		}
+
+		if len(c.rules) == 0 {
+			skipped = append(skipped, LoadIssue{File: name, Name: tech, Detail: "no pattern with a literal part"})
+			continue
+		}
+		args = append(args, FingerArg{
+			Name:     tech,
+			Key:      joinRules(c.rules, "||"),
+			Versions: c.versions,
+		})
+	}
+	return args, skipped, nil
+}
+
+type wappalyzerConverter struct {
+	rules    []string
+	versions []VersionArg
+}
+
+func (c *wappalyzerConverter) rule(rule string) {
+	c.rules = append(c.rules, rule)
+}
+
+func (c *wappalyzerConverter) header(name, pattern string) {
+	re, group := splitWappalyzerPattern(pattern)
+	name = strings.ToLower(name)
+	literals, anchored, ok := regexLiterals(re)
+	switch {
+	case !ok:
+		return
+	case len(literals) == 0:
+		c.rule(quoteRule("header", name+":"))
+	case anchored:
+		rules := []string{quoteRule("header", name+": "+literals[0])}
+		for _, literal := range literals[1:] {
+			rules = append(rules, quoteRule("header", literal))
+		}
+		c.rule(groupRules(rules, "&&"))
+	default:
+		rules := []string{quoteRule("header", name+":")}
+		for _, literal := range literals {
+			rules = append(rules, quoteRule("header", literal))
+		}
+		c.rule(groupRules(rules, "&&"))
+	}
+
+	if group > 0 {
+		prefix := ".*?"
+		if strings.HasPrefix(re, "^") {
+			re, prefix = re[1:], ""
+		}
+		c.version("header", `(?im)^`+regexp.QuoteMeta(name)+`:\s*`+prefix+re, group)
+	}
+}
+
+func (c *wappalyzerConverter) body(pattern string) {
+	re, group := splitWappalyzerPattern(pattern)
+	literals, _, ok := regexLiterals(re)
+	if !ok || len(literals) == 0 {
+		return
+	}
+	rules := make([]string, 0, len(literals))
+	for _, literal := range literals {
+		rules = append(rules, quoteRule("body", literal))
+	}
+	c.rule(groupRules(rules, "&&"))
+	if group > 0 {
+		c.version("body", "(?i)"+strings.TrimPrefix(re, "^"), group)
+	}
+}
+
+// meta matches pattern against the content of the meta tag called name.
+func (c *wappalyzerConverter) meta(name, pattern string) {
+	re, group := splitWappalyzerPattern(pattern)
+	literals, _, ok := regexLiterals(re)
+	if !ok {
+		return
+	}
+	name = strings.ToLower(name)
+	rules := []string{quoteRule("body", name)}
+	for _, literal := range literals {
+		rules = append(rules, quoteRule("body", literal))
+	}
+	c.rule(groupRules(rules, "&&"))
+	if group > 0 {
+		tag := `(?is)<meta[^>]+(?:name|property)=["']?` + regexp.QuoteMeta(name) + `["']?[^>]*content=["']?`
+		c.version("body", tag+strings.TrimPrefix(re, "^"), group)
+	}
+}
+
+// version keeps re when Go can compile it, Wappalyzer being written for
+// JavaScript regular expressions.
+func (c *wappalyzerConverter) version(part, re string, group int) {
+	compiled, err := regexp.Compile(re)
+	if err != nil || group > compiled.NumSubexp() {
+		return
+	}
+	c.versions = append(c.versions, VersionArg{Part: part, Regex: re, Group: group})
+}
+
+// splitWappalyzerPattern separates a pattern from its \; tags and returns the
+// capture group of a plain "version:\N" tag, or 0.
+func splitWappalyzerPattern(pattern string) (string, int) {
+	parts := strings.Split(pattern, `\;`)
+	group := 0
+	for _, tag := range parts[1:] {
+		if strings.HasPrefix(tag, `version:\`) {
+			if n, err := strconv.Atoi(strings.TrimPrefix(tag, `version:\`)); err == nil {
+				group = n
+			}
+		}
+	}
+	return parts[0], group
+}
+
+// minLiteral is the shortest literal worth a condition of its own.
+const minLiteral = 3
+
+// regexLiterals returns the literal runs that every match of re contains, in
+// order, and whether the first of them starts the match. ok is false when re
+// does not parse.
+func regexLiterals(re string) (literals []string, anchored, ok bool) {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return nil, false, false
+	}
+	parsed = parsed.Simplify()
+
+	subs := []*syntax.Regexp{parsed}
+	if parsed.Op == syntax.OpConcat {
+		subs = parsed.Sub
+	}
+	if len(subs) > 0 && (subs[0].Op == syntax.OpBeginText || subs[0].Op == syntax.OpBeginLine) {
+		anchored = true
+		subs = subs[1:]
+	}
+
+	var run strings.Builder
+	flush := func() {
+		if run.Len() >= minLiteral || (run.Len() > 0 && len(literals) == 0 && anchored) {
+			literals = append(literals, run.String())
+		} else if len(literals) == 0 {
+			anchored = false
+		}
+		run.Reset()
+	}
+	for _, sub := range subs {
+		switch sub.Op {
+		case syntax.OpLiteral:
+			run.WriteString(string(sub.Rune))
+		case syntax.OpEmptyMatch:
+		default:
+			flush()
+		}
+	}
+	flush()
+	return literals, anchored, true
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,254 @@
+package fingerscan
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"heaven/app/APVE/pkg/common/requests"
+)
+
+const (
+	// maxHTMLRedirects bounds the meta refresh and script redirects followed
+	// from the landing page
+	maxHTMLRedirects = 3
+	// script redirects are only trusted on small pages, larger ones tend to
+	// assign location in event handlers
+	maxScriptRedirectPage = 4 << 10
+)
+
+// sendRequest fetches url and normalizes the page the way a browser would show
+// it: decompressed, decoded to UTF-8, with meta refresh and script redirects
+// followed. Response.Url stays url, the page actually parsed is FinalUrl, and
+// the page that redirected to it is kept as Landing.
+func sendRequest(ctx context.Context, url string, timeout int) (Response, error) {
+	raw, err := fetchRaw(ctx, url, timeout, 0)
+	if err != nil {
+		return Response{}, err
+	}
+	body, charset := requests.DecodeBody(raw.header, raw.body)
+	landing := &Response{
+		Url:           url,
+		FinalUrl:      raw.url,
+		StateCode:     raw.status,
+		Body:          body,
+		Title:         htmlTitle(body),
+		Header:        raw.header,
+		Charset:       charset,
+		ContentLength: int64(len(raw.body)),
+	}
+
+	seen := map[string]bool{url: true, raw.url: true}
+	for i := 0; i < maxHTMLRedirects; i++ {
+		next := htmlRedirect(raw.url, body)
+		if next == "" || seen[next] {
+			break
+		}
+		seen[next] = true
+
+		nextRaw, err := fetchRaw(ctx, next, timeout, 0)
+		if err != nil {
+			// the page that redirected is still worth fingerprinting
+			break
+		}
+		raw = nextRaw
+		seen[raw.url] = true
+		body, charset = requests.DecodeBody(raw.header, raw.body)
+	}
+
+	if raw.url == landing.FinalUrl {
+		return *landing, nil
+	}
+	return Response{
+		Url:           url,
+		FinalUrl:      raw.url,
+		StateCode:     raw.status,
+		Body:          body,
+		Title:         htmlTitle(body),
+		Header:        raw.header,
+		Charset:       charset,
+		ContentLength: int64(len(raw.body)),
+		Landing:       landing,
+	}, nil
+}
+
+// decodeContent undoes the Content-Encoding of body. Encodings it does not
+// know, and bodies that are not actually compressed, are returned as is.
+func decodeContent(encoding string, body io.Reader) (io.Reader, error) {
+	encodings := strings.Split(encoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		br := bufio.NewReader(body)
+		magic, _ := br.Peek(2)
+		body = br
+
+		switch strings.ToLower(strings.TrimSpace(encodings[i])) {
+		case "gzip", "x-gzip":
+			if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+				continue
+			}
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			body = zr
+		case "deflate":
+			if len(magic) == 0 {
+				continue
+			}
+			// deflate is meant to be zlib wrapped, many servers send it raw
+			if len(magic) == 2 && magic[0]&0x0f == 8 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0 {
+				zr, err := zlib.NewReader(br)
+				if err != nil {
+					return nil, err
+				}
+				body = zr
+			} else {
+				body = flate.NewReader(br)
+			}
+		}
+	}
+	return body, nil
+}
+
+// htmlTitle returns the text of the document title, entities decoded and
+// white space collapsed. Titles of inline SVG images are not the page title.
+func htmlTitle(body string) string {
+	z := html.NewTokenizer(strings.NewReader(body))
+	svg := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "svg":
+				svg++
+			case "title":
+				if svg > 0 {
+					continue
+				}
+				var b strings.Builder
+				for z.Next() == html.TextToken {
+					b.Write(z.Text())
+				}
+				return strings.Join(strings.Fields(b.String()), " ")
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "svg" && svg > 0 {
+				svg--
+			}
+		}
+	}
+}
+
+var scriptRedirectRe = regexp.MustCompile(`(?:\b(?:window|top|self|parent|document)\.)?\blocation(?:\.href)?\s*=\s*["']([^"']+)["']|\blocation\.(?:replace|assign)\(\s*["']([^"']+)["']\s*\)`)
+
+// htmlRedirect returns the absolute url a meta refresh or a script sends the
+// page at base to, or "".
+func htmlRedirect(base, body string) string {
+	var target string
+	var scripts strings.Builder
+	z := html.NewTokenizer(strings.NewReader(body))
+	inScript := false
+scan:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break scan
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "script":
+				inScript = true
+			case "meta":
+				if hasAttr {
+					if refresh := metaRefresh(z); refresh != "" {
+						target = refresh
+						break scan
+					}
+				}
+			}
+		case html.EndTagToken:
+			inScript = false
+		case html.TextToken:
+			if inScript {
+				scripts.Write(z.Text())
+				scripts.WriteByte('\n')
+			}
+		}
+	}
+
+	if target == "" && len(body) <= maxScriptRedirectPage {
+		if m := scriptRedirectRe.FindStringSubmatch(scripts.String()); m != nil {
+			target = m[1] + m[2]
+		}
+	}
+	return resolveRedirect(base, target)
+}
+
+// metaRefresh returns the url of a <meta http-equiv="refresh"> tag, whose
+// attributes z is positioned on.
+func metaRefresh(z *html.Tokenizer) string {
+	var equiv, content string
+	for {
+		key, value, more := z.TagAttr()
+		switch strings.ToLower(string(key)) {
+		case "http-equiv":
+			equiv = strings.ToLower(string(value))
+		case "content":
+			content = string(value)
+		}
+		if !more {
+			break
+		}
+	}
+	if equiv != "refresh" {
+		return ""
+	}
+
+	// content is "<delay>; url=<url>", the url part being optional
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return ""
+	}
+	if _, err := strconv.ParseFloat(strings.TrimSpace(content[:i]), 64); err != nil {
+		return ""
+	}
+	ref := strings.TrimSpace(content[i+1:])
+	if len(ref) >= 4 && strings.EqualFold(ref[:3], "url") {
+		if rest := strings.TrimSpace(ref[3:]); strings.HasPrefix(rest, "=") {
+			ref = strings.TrimSpace(rest[1:])
+		}
+	}
+	return strings.Trim(ref, `"'`)
+}
+
+func resolveRedirect(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ""
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	u, err := baseURL.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	u.Fragment = ""
+	if u.String() == baseURL.String() {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,233 @@
+package fingerscan
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"math/bits"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultProbeTimeout = 5
+	// probed paths are hashed, not parsed, so a small cap is enough
+	maxProbeSize = 2 << 20
+)
+
+// probeResult is one fetched path. err is kept so a failed probe is not
+// retried for the same target.
+type probeResult struct {
+	status int
+	body   []byte
+	err    error
+}
+
+type probeEntry struct {
+	once   sync.Once
+	result probeResult
+}
+
+// probeCache fetches extra urls of one target, each at most once, no matter
+// how many fingerprints ask for it.
+type probeCache struct {
+	ctx     context.Context
+	base    string
+	timeout int
+
+	mu      sync.Mutex
+	entries map[string]*probeEntry
+}
+
+func newProbeCache(ctx context.Context, base string, timeout int) *probeCache {
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	return &probeCache{
+		ctx:     ctx,
+		base:    base,
+		timeout: timeout,
+		entries: make(map[string]*probeEntry),
+	}
+}
+
+// path fetches path relative to the target url.
+func (c *probeCache) path(path string) probeResult {
+	return c.fetch(joinURL(c.base, path))
+}
+
+func (c *probeCache) fetch(rawurl string) probeResult {
+	c.mu.Lock()
+	entry, ok := c.entries[rawurl]
+	if !ok {
+		entry = &probeEntry{}
+		c.entries[rawurl] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		raw, err := fetchRaw(c.ctx, rawurl, c.timeout, maxProbeSize)
+		if err != nil {
+			entry.result = probeResult{err: err}
+			return
+		}
+		entry.result = probeResult{status: raw.status, body: raw.body}
+	})
+	return entry.result
+}
+
+// joinURL appends path to base the way fingerprint paths are written.
+func joinURL(base, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func hasProbe(finger *fingerprint) bool {
+	for _, hash := range finger.Path {
+		if hash.Url != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathHash compares the MD5 of every path of finger with the expected
+// hash and returns the path that matched. Paths that cannot be fetched simply
+// do not match.
+func matchPathHash(probes *probeCache, finger *fingerprint) (UrlHash, bool) {
+	for _, hash := range finger.Path {
+		if hash.Url == "" {
+			continue
+		}
+		result := probes.path(hash.Url)
+		if result.err != nil || result.status != 200 {
+			continue
+		}
+		if md5Hex(result.body) == strings.ToLower(hash.Hash) {
+			return hash, true
+		}
+	}
+	return UrlHash{}, false
+}
+
+var (
+	linkRe = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	relRe  = regexp.MustCompile(`(?is)\brel\s*=\s*["']?([^"'>]*)`)
+	hrefRe = regexp.MustCompile(`(?is)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// faviconURLs lists the icons declared by body, followed by /favicon.ico at
+// the root of base.
+func faviconURLs(base, body string) []string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+
+	var urls []string
+	seen := make(map[string]bool)
+	add := func(ref string) {
+		u, err := baseURL.Parse(strings.TrimSpace(ref))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		if !seen[u.String()] {
+			seen[u.String()] = true
+			urls = append(urls, u.String())
+		}
+	}
+
+	for _, link := range linkRe.FindAllString(body, -1) {
+		rel := relRe.FindStringSubmatch(link)
+		if rel == nil || !strings.Contains(strings.ToLower(rel[1]), "icon") {
+			continue
+		}
+		if href := hrefRe.FindStringSubmatch(link); href != nil {
+			add(href[1] + href[2] + href[3])
+		}
+	}
+	add("/favicon.ico")
+	return urls
+}
+
+// favicons fetches the icons declared by the page at base and returns their
+// mmh3 and MD5 hashes. Icons that fail to load are skipped.
+func (c *probeCache) favicons(base, body string) (mmh3s, md5s []string) {
+	for _, u := range faviconURLs(base, body) {
+		result := c.fetch(u)
+		if result.err != nil || result.status != 200 || len(result.body) == 0 {
+			continue
+		}
+		mmh3s = append(mmh3s, faviconHash(result.body))
+		md5s = append(md5s, md5Hex(result.body))
+	}
+	return mmh3s, md5s
+}
+
+// faviconHash is the Shodan favicon hash: the signed 32-bit murmur3 of the
+// base64 encoding with a newline after every 76 characters and at the end.
+func faviconHash(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteByte('\n')
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteByte('\n')
+	return strconv.Itoa(int(int32(murmur3(b.Bytes()))))
+}
+
+// murmur3 is MurmurHash3 x86_32 with a zero seed.
+func murmur3(data []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	var h uint32
+	n := len(data)
+	for ; len(data) >= 4; data = data[4:] {
+		k := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
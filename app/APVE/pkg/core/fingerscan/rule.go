@@ -0,0 +1,528 @@
+package fingerscan
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/*
+Fingerprint rule language, as used by the "keys" field of Hfinger.json:
+
+	expr    = or
+	or      = and { "||" and }
+	and     = unary { "&&" unary }
+	unary   = "!" unary | primary
+	primary = "(" expr ")" | field op value
+	op      = "=" | "==" | "!="
+	value   = quoted string | bare word
+
+"=" is a case-insensitive substring match, "==" a case-insensitive exact match
+and "!=" the negation of "=". "&&" binds tighter than "||".
+
+Many community rules embed unescaped double quotes in their values, e.g.
+body="<div class="login">". A quote therefore only closes a string when it is
+followed by the end of the rule, "&&", "||", or ")" while inside a group;
+`\"` can be used for an explicit quote.
+*/
+
+type ruleOp int
+
+const (
+	opContains ruleOp = iota
+	opEqual
+	opNotContains
+)
+
+func (op ruleOp) String() string {
+	switch op {
+	case opEqual:
+		return "=="
+	case opNotContains:
+		return "!="
+	default:
+		return "="
+	}
+}
+
+// fields understood by the matcher:
+//
+//	title    page <title>
+//	body     response body
+//	header   every response header, as "name: value" lines
+//	server   the Server header
+//	banner   raw service banner read from a non-HTTP port
+//	protocol detected application protocol, e.g. http, https, ftp, ssh
+//	type     "subdomain" for web targets, "service" for raw TCP services
+//	port     target port
+//	icon_hash  Shodan-style mmh3 hash of a favicon
+//	icon_md5   MD5 of a favicon
+//
+// port and the icon fields hold single tokens, "=" compares them exactly.
+var ruleFields = map[string]bool{
+	"title":     true,
+	"body":      true,
+	"header":    true,
+	"server":    true,
+	"banner":    true,
+	"protocol":  true,
+	"type":      true,
+	"port":      true,
+	"icon_hash": true,
+	"icon_md5":  true,
+}
+
+var exactFields = map[string]bool{
+	"port":      true,
+	"icon_hash": true,
+	"icon_md5":  true,
+}
+
+// iconFields need the favicon of the target to be fetched
+var iconFields = map[string]bool{
+	"icon_hash": true,
+	"icon_md5":  true,
+}
+
+type ruleNode interface {
+	match(t *target) bool
+	String() string
+}
+
+type andNode struct{ left, right ruleNode }
+type orNode struct{ left, right ruleNode }
+type notNode struct{ expr ruleNode }
+
+type condNode struct {
+	field string
+	op    ruleOp
+	value string
+	lower string
+}
+
+func (n *andNode) match(t *target) bool { return n.left.match(t) && n.right.match(t) }
+func (n *orNode) match(t *target) bool  { return n.left.match(t) || n.right.match(t) }
+func (n *notNode) match(t *target) bool { return !n.expr.match(t) }
+
+func (n *andNode) String() string { return fmt.Sprintf("(%s && %s)", n.left, n.right) }
+func (n *orNode) String() string  { return fmt.Sprintf("(%s || %s)", n.left, n.right) }
+func (n *notNode) String() string { return fmt.Sprintf("!%s", n.expr) }
+func (n *condNode) String() string {
+	return fmt.Sprintf("%s%s%q", n.field, n.op, n.value)
+}
+
+func (n *condNode) match(t *target) bool {
+	switch n.op {
+	case opEqual:
+		return t.equal(n.field, n.lower)
+	case opNotContains:
+		return !t.contains(n.field, n.lower)
+	default:
+		return t.contains(n.field, n.lower)
+	}
+}
+
+// target is a response with every field lower-cased once, so that rules can
+// be evaluated without re-normalizing the response per condition. text holds
+// what "=" and "!=" search in, values the candidates "==" compares against
+// and raw the original text, for evidence and version extraction.
+type target struct {
+	text   map[string]string
+	values map[string][]string
+	raw    map[string]string
+}
+
+func newTarget(response Response) *target {
+	t := &target{
+		text:   make(map[string]string, len(ruleFields)),
+		values: make(map[string][]string, len(ruleFields)),
+		raw:    make(map[string]string, len(ruleFields)),
+	}
+
+	protocol := strings.ToLower(response.Protocol)
+	if protocol == "" {
+		protocol = "http"
+		if u, err := url.Parse(response.Url); err == nil && u.Scheme != "" {
+			protocol = strings.ToLower(u.Scheme)
+		}
+	}
+	targetType := "service"
+	if protocol == "http" || protocol == "https" {
+		targetType = "subdomain"
+	}
+
+	t.set("title", response.Title)
+	t.set("body", response.Body)
+	t.set("banner", response.Banner)
+	t.set("protocol", protocol)
+	t.set("type", targetType)
+	t.set("port", targetPort(response.Url, protocol))
+
+	names := make([]string, 0, len(response.Header))
+	for name := range response.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range response.Header[name] {
+			t.values["header"] = append(t.values["header"], strings.TrimSpace(strings.ToLower(value)))
+			b.WriteString(name)
+			b.WriteString(": ")
+			b.WriteString(value)
+			b.WriteString("\n")
+		}
+	}
+	t.raw["header"] = b.String()
+	t.text["header"] = strings.ToLower(b.String())
+
+	t.setValues("server", response.Header.Values("Server"))
+	return t
+}
+
+func (t *target) set(field, value string) {
+	t.raw[field] = value
+	value = strings.ToLower(value)
+	t.text[field] = value
+	t.values[field] = []string{strings.TrimSpace(value)}
+}
+
+// setValues stores a field that may hold several values, e.g. one hash per
+// favicon.
+func (t *target) setValues(field string, values []string) {
+	t.values[field] = nil
+	for _, value := range values {
+		t.values[field] = append(t.values[field], strings.TrimSpace(strings.ToLower(value)))
+	}
+	t.raw[field] = strings.Join(values, "\n")
+	t.text[field] = strings.Join(t.values[field], "\n")
+}
+
+func (t *target) contains(field, value string) bool {
+	if exactFields[field] {
+		return t.equal(field, value)
+	}
+	return strings.Contains(t.text[field], value)
+}
+
+func (t *target) equal(field, value string) bool {
+	for _, candidate := range t.values[field] {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// targetPort returns the port of rawurl, falling back to the protocol default.
+func targetPort(rawurl, protocol string) string {
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return port
+	}
+	if port, ok := defaultPorts[protocol]; ok {
+		return port
+	}
+	return ""
+}
+
+var defaultPorts = map[string]string{
+	"http":      "80",
+	"https":     "443",
+	"ftp":       "21",
+	"ssh":       "22",
+	"telnet":    "23",
+	"smtp":      "25",
+	"pop3":      "110",
+	"imap":      "143",
+	"rtsp":      "554",
+	"rsync":     "873",
+	"mysql":     "3306",
+	"vnc":       "5900",
+	"redis":     "6379",
+	"memcached": "11211",
+}
+
+// usesField reports whether any condition of node tests one of fields.
+func usesField(node ruleNode, fields map[string]bool) bool {
+	switch n := node.(type) {
+	case *condNode:
+		return fields[n.field]
+	case *andNode:
+		return usesField(n.left, fields) || usesField(n.right, fields)
+	case *orNode:
+		return usesField(n.left, fields) || usesField(n.right, fields)
+	case *notNode:
+		return usesField(n.expr, fields)
+	}
+	return false
+}
+
+type ruleParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func parseRule(src string) (ruleNode, error) {
+	p := &ruleParser{src: src}
+	p.skipSpace()
+	if p.eof() {
+		return nil, fmt.Errorf("empty rule")
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.rest())
+	}
+	return node, nil
+}
+
+func (p *ruleParser) parseOr() (ruleNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if !p.consume("||") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+}
+
+func (p *ruleParser) parseAnd() (ruleNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if !p.consume("&&") {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+}
+
+func (p *ruleParser) parseUnary() (ruleNode, error) {
+	p.skipSpace()
+	if p.consume("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *ruleParser) parsePrimary() (ruleNode, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("unexpected end of rule")
+	}
+
+	if p.consume("(") {
+		p.depth++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, p.errorf("missing )")
+		}
+		p.depth--
+		return node, nil
+	}
+
+	return p.parseCond()
+}
+
+func (p *ruleParser) parseCond() (ruleNode, error) {
+	start := p.pos
+	for !p.eof() && isIdentByte(p.src[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, p.errorf("expected field name, got %q", p.rest())
+	}
+	field := strings.ToLower(p.src[start:p.pos])
+	if !ruleFields[field] {
+		p.pos = start
+		return nil, p.errorf("unsupported field %q", field)
+	}
+
+	p.skipSpace()
+	var op ruleOp
+	switch {
+	case p.consume("=="):
+		op = opEqual
+	case p.consume("!="):
+		op = opNotContains
+	case p.consume("="):
+		op = opContains
+	default:
+		return nil, p.errorf("expected =, == or != after %q", field)
+	}
+
+	p.skipSpace()
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	cond := &condNode{field: field, op: op, value: value, lower: strings.ToLower(value)}
+	if op == opEqual {
+		cond.lower = strings.TrimSpace(cond.lower)
+	}
+	return cond, nil
+}
+
+func (p *ruleParser) parseValue() (string, error) {
+	if p.eof() {
+		return "", p.errorf("missing value")
+	}
+	if p.src[p.pos] != '"' {
+		return p.parseBareWord()
+	}
+
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for !p.eof() {
+		c := p.src[p.pos]
+		if c == '\\' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '"' {
+			b.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		p.pos++
+		if c == '"' && p.closesString() {
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+// closesString reports whether the quote just consumed ends the string.
+func (p *ruleParser) closesString() bool {
+	rest := strings.TrimLeft(p.src[p.pos:], " \t\r\n")
+	switch {
+	case rest == "":
+		return true
+	case strings.HasPrefix(rest, "&&"), strings.HasPrefix(rest, "||"):
+		return true
+	case strings.HasPrefix(rest, ")"):
+		return p.depth > 0
+	}
+	return false
+}
+
+func (p *ruleParser) parseBareWord() (string, error) {
+	start := p.pos
+	for !p.eof() {
+		rest := p.src[p.pos:]
+		if strings.HasPrefix(rest, "&&") || strings.HasPrefix(rest, "||") {
+			break
+		}
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' || (c == ')' && p.depth > 0) {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("missing value")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *ruleParser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) skipSpace() {
+	for !p.eof() {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *ruleParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *ruleParser) rest() string {
+	rest := p.src[p.pos:]
+	if len(rest) > 20 {
+		rest = rest[:20] + "..."
+	}
+	return rest
+}
+
+func (p *ruleParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// RuleError describes a fingerprint whose keys could not be parsed.
+type RuleError struct {
+	Id   int
+	Name string
+	Keys string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("fingerprint %d (%s): %v", e.Id, e.Name, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// RuleErrors is returned by the loader when some fingerprints were skipped.
+type RuleErrors []*RuleError
+
+func (e RuleErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d invalid fingerprint rules: %s", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,157 @@
+package fingerscan
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// VersionArg declares how to extract the product version once a fingerprint
+// matched. Regex is applied to Part and the capture group Group (1 by
+// default, 0 when the regex has no group) is the version.
+//
+// Part is one of header, server, title, body, banner or path; path fetches
+// Path relative to the target, like FingerArg.Path does.
+type VersionArg struct {
+	Part  string `json:"part"`
+	Path  string `json:"path,omitempty"`
+	Regex string `json:"regex"`
+	Group int    `json:"group,omitempty"`
+}
+
+var versionParts = map[string]bool{
+	"header": true,
+	"server": true,
+	"title":  true,
+	"body":   true,
+	"banner": true,
+	"path":   true,
+}
+
+type versionExtractor struct {
+	part  string
+	path  string
+	re    *regexp.Regexp
+	group int
+}
+
+// compileVersions compiles the extractors of arg. A non-empty
+// FingerArg.Version is shorthand for the same regex over header then body.
+func compileVersions(arg FingerArg) ([]*versionExtractor, error) {
+	args := arg.Versions
+	if arg.Version != "" {
+		args = append(args,
+			VersionArg{Part: "header", Regex: arg.Version},
+			VersionArg{Part: "body", Regex: arg.Version},
+		)
+	}
+
+	extractors := make([]*versionExtractor, 0, len(args))
+	for _, v := range args {
+		part := strings.ToLower(v.Part)
+		if !versionParts[part] {
+			return nil, fmt.Errorf("version: unsupported part %q", v.Part)
+		}
+		if part == "path" && v.Path == "" {
+			return nil, fmt.Errorf("version: part path needs a path")
+		}
+		re, err := regexp.Compile(v.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("version: %v", err)
+		}
+
+		group := v.Group
+		if group == 0 && re.NumSubexp() > 0 {
+			group = 1
+		}
+		if group > re.NumSubexp() {
+			return nil, fmt.Errorf("version: regex %q has no group %d", v.Regex, group)
+		}
+		extractors = append(extractors, &versionExtractor{part: part, path: v.Path, re: re, group: group})
+	}
+	return extractors, nil
+}
+
+// extractVersion returns the first version found by the extractors of finger.
+func extractVersion(finger *fingerprint, t *target, probes *probeCache) string {
+	for _, v := range finger.versions {
+		var text string
+		if v.part == "path" {
+			result := probes.path(v.path)
+			if result.err != nil || result.status != 200 {
+				continue
+			}
+			text = string(result.body)
+		} else {
+			text = t.raw[v.part]
+		}
+
+		if m := v.re.FindStringSubmatch(text); m != nil {
+			if version := strings.TrimSpace(m[v.group]); version != "" {
+				return version
+			}
+		}
+	}
+	return ""
+}
+
+// evidenceCond returns a positive condition that made node true, nil when the
+// match only rests on negations.
+func evidenceCond(node ruleNode, t *target) *condNode {
+	switch n := node.(type) {
+	case *condNode:
+		if n.op != opNotContains && n.match(t) {
+			return n
+		}
+	case *andNode:
+		if cond := evidenceCond(n.left, t); cond != nil {
+			return cond
+		}
+		return evidenceCond(n.right, t)
+	case *orNode:
+		if n.left.match(t) {
+			if cond := evidenceCond(n.left, t); cond != nil {
+				return cond
+			}
+		}
+		if n.right.match(t) {
+			return evidenceCond(n.right, t)
+		}
+	}
+	return nil
+}
+
+const evidenceContext = 40
+
+// evidence quotes the part of the response that satisfied cond.
+func evidence(cond *condNode, t *target) string {
+	if cond == nil {
+		return ""
+	}
+
+	raw, lower := t.raw[cond.field], t.text[cond.field]
+	i := strings.Index(lower, cond.lower)
+	if i < 0 || cond.lower == "" {
+		return fmt.Sprintf("%s: %s", cond.field, cond.value)
+	}
+	// lower-casing may change the byte length of non-ASCII text
+	if len(raw) != len(lower) {
+		raw = lower
+	}
+
+	start, end := i-evidenceContext, i+len(cond.lower)+evidenceContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(raw) {
+		end = len(raw)
+	}
+	for start > 0 && !utf8.RuneStart(raw[start]) {
+		start--
+	}
+	for end < len(raw) && !utf8.RuneStart(raw[end]) {
+		end++
+	}
+	return fmt.Sprintf("%s: %s", cond.field, strings.TrimSpace(raw[start:end]))
+}
@@ -1,355 +1,248 @@
 package fingerscan
 
 import (
-	"crypto/md5"
-	"crypto/tls"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
+	"context"
 	browser "github.com/EDDYCJY/fake-useragent"
-	"github.com/axgle/mahonia"
+	"heaven/app/APVE/pkg/common/requests"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
-	"regexp"
-	"strings"
+	"sync"
 	"time"
 )
 
 type UrlHash struct {
-	Url string `json:"url"`
+	Url  string `json:"url"`
 	Hash string `json:"MD5"`
 }
 
 type FingerArg struct {
-	Id int `json:"id"`
-	Name string `json:"name"`
-	Key string `json:"keys"`
-	Version string `json:"version"`
-	Path []UrlHash `json:"path"`
+	Id      int       `json:"id"`
+	Name    string    `json:"name"`
+	Key     string    `json:"keys"`
+	Path    []UrlHash `json:"path"`
+	Version string    `json:"version"`
+	// Versions extract the product version after a match
+	Versions []VersionArg `json:"versions,omitempty"`
 }
 
 type Response struct {
-	Url       string
+	Url string
+	// FinalUrl is the page Body comes from, after HTTP, meta refresh and
+	// script redirects
+	FinalUrl  string
 	StateCode int
 	Body      string
 	Title     string
 	Header    http.Header
+	// Banner is the raw greeting of a non-HTTP service
+	Banner string
+	// Protocol is the detected application protocol, derived from the
+	// url scheme when empty
+	Protocol string
+	// Charset is the encoding Body was decoded from
+	Charset string
+	// ContentLength is the size of the decompressed body, len(Body) is used
+	// when it is zero
+	ContentLength int64
+	// Landing is the page at Url when Body comes from a meta refresh or
+	// script redirect. Rules are matched against it too, since many only
+	// recognise the redirect page itself.
+	Landing *Response
 }
 
 type Results struct {
-	Url         string
+	Url        string
+	FinalUrl   string
+	StatusCode int
+	Title      string
+	Server     string
+	// ContentLength is the size of the decompressed body
+	ContentLength int64
+	Charset       string
+	// Protocol and Banner are set for TCP services
+	Protocol    string
+	Banner      string
 	FingerPrint []string
+	// Matches details every entry of FingerPrint, in the same order
+	Matches []Match
+	// ScannedAt is when the scan started. FetchTime is spent getting the
+	// page, MatchTime matching it, favicon and path probes included.
+	ScannedAt time.Time
+	FetchTime time.Duration
+	MatchTime time.Duration
 }
 
-func initFingerprintFile(name string) (*[]FingerArg, error) {
-	fileData, err := ioutil.ReadFile(name)
-	if err != nil {
-		return nil, err
-	}
-
-	var FingerArgs []FingerArg
-	err = json.Unmarshal(fileData, &FingerArgs)
-	if err != nil {
-		return nil, err
-	}
-
-	return &FingerArgs, nil
+// Match is one identified product.
+type Match struct {
+	Id      int
+	Name    string
+	Version string
+	// Rule is the keys expression, or the path hash, that matched
+	Rule string
+	// Evidence quotes the part of the response the rule matched on
+	Evidence string
 }
 
-func sendRequest(url string, timeout int) (Response, error) {
-	var insecureSkipVerify bool
-	if strings.Contains(url, "https") {
-		insecureSkipVerify = true
-	}
+type fingerprint struct {
+	FingerArg
+	rule     ruleNode
+	versions []*versionExtractor
+}
 
-	body, statusCode, title, header, err := newHTTPClient(url, insecureSkipVerify, timeout)
+// initFingerprintFile loads and compiles the fingerprint database, a file or
+// a directory of rule files, see LoadFingerArgs. Fingerprints whose keys do
+// not parse are left out and reported through RuleErrors, the remaining ones
+// are still returned.
+func initFingerprintFile(name string) ([]*fingerprint, error) {
+	fingerprints, report, err := loadFingerprints(name)
 	if err != nil {
-		return Response{}, err
+		return nil, err
 	}
-
-	//if statusCode != 200 {
-	//	return Response{}, errors.New(fmt.Sprintf("http status code %d\n", statusCode))
-	//}
-
-	response := Response{
-		Url:       url,
-		StateCode: statusCode,
-		Body:      body,
-		Title:     title,
-		Header:    header,
+	if len(report.Invalid) > 0 {
+		return fingerprints, report.Invalid
 	}
-
-	return response, nil
+	return fingerprints, nil
 }
 
-func checkRule(rule string, response Response) bool {
-	if strings.Contains(rule, "title=") {
-		re := regexp.MustCompile("title=\"(.*)\"")
-		titleTexts := re.FindAllStringSubmatch(rule, -1)
-		if len(titleTexts) > 0 {
-			titleText := titleTexts[0][1]
-			if strings.Contains(strings.ToLower(response.Title), strings.ToLower(titleText)) {
-				return true
-			}
+func compileFingerprints(fingerArgs []FingerArg) ([]*fingerprint, error) {
+	var ruleErrs RuleErrors
+	fingerprints := make([]*fingerprint, 0, len(fingerArgs))
+	for _, arg := range fingerArgs {
+		rule, err := parseRule(arg.Key)
+		if err != nil {
+			ruleErrs = append(ruleErrs, &RuleError{Id: arg.Id, Name: arg.Name, Keys: arg.Key, Err: err})
+			continue
 		}
-	}
-
-	if strings.Contains(rule, "body=") {
-		re := regexp.MustCompile("body=\"(.*)\"")
-		bodyTexts := re.FindAllStringSubmatch(rule, -1)
-		if len(bodyTexts) > 0 {
-			bodyText := bodyTexts[0][1]
-			if strings.Contains(strings.ToLower(response.Body), strings.ToLower(bodyText)) {
-				return true
-			}
+		versions, err := compileVersions(arg)
+		if err != nil {
+			ruleErrs = append(ruleErrs, &RuleError{Id: arg.Id, Name: arg.Name, Keys: arg.Key, Err: err})
+			continue
 		}
+		fingerprints = append(fingerprints, &fingerprint{FingerArg: arg, rule: rule, versions: versions})
 	}
 
-	if strings.Contains(rule, "header=") {
-		re := regexp.MustCompile("header=\"(.*)\"")
-		headerTexts := re.FindAllStringSubmatch(rule, -1)
-		if len(headerTexts) > 0 {
-			headerText := headerTexts[0][1]
-			for _, headers := range response.Header {
-				for _, header := range headers {
-					if strings.Contains(strings.ToLower(header), strings.ToLower(headerText)) {
-						return true
-					}
-				}
-			}
-		}
+	if len(ruleErrs) > 0 {
+		return fingerprints, ruleErrs
 	}
-	return false
+	return fingerprints, nil
 }
 
-func identifyResponse(fingerArgs *[]FingerArg, response Response) (Results, error) {
-	results := Results{
-		Url:         response.Url,
-		FingerPrint: []string{},
-	}
-
-	for _, finger := range *fingerArgs {
-		or := strings.Contains(finger.Key, "||")
-		and := strings.Contains(finger.Key, "&&")
-		brackets := strings.Contains(finger.Key, "(")
-		bracketLR := strings.Contains(finger.Key, "()")
-
-		// 1||2||3
-		if or == true && and == false && brackets == false {
-			for _, rule := range strings.Split(finger.Key, "||") {
-				if checkRule(rule, response) {
-					results.FingerPrint = append(results.FingerPrint, finger.Name)
-					break
-				}
-			}
-		}
-
-		// 1&&2&&3
-		if and == true && or == false && brackets == false {
-			var i int
-
-			for _, rule := range strings.Split(finger.Key, "&&") {
-				if checkRule(rule, response) {
-					i += 1
-				}
-			}
-
-			if i == len(strings.Split(finger.Key, "&&")) {
-				results.FingerPrint = append(results.FingerPrint, finger.Name)
-			}
-		}
-
-		// 1
-		if and == false && or == false && brackets == false {
-			if checkRule(finger.Key, response) {
-				results.FingerPrint = append(results.FingerPrint, finger.Name)
-			}
-		}
-
-		// 1||2||(3&&4) or 1&&2&&(3||4)
-		if and == true && or == true && brackets == true && bracketLR == false {
-			re := regexp.MustCompile("\\((.*)\\)")
-			bracketRules := re.FindAllStringSubmatch(finger.Key, -1)
-
-			if len(bracketRules) == 1 {
-				bracketRule := bracketRules[0][0]
-				// 1||2||(3&&4)
-				if strings.Contains(bracketRule, "&&") {
-					for _, rule := range strings.Split(finger.Key, "||") {
-						if strings.Contains(rule, "&&") {
-							// remove bracket
-							var i int
-							for _, _rule := range strings.Split(bracketRules[0][1], "&&") {
-								if checkRule(_rule, response) {
-									i += 1
-								}
-							}
-
-							if i == len(strings.Split(bracketRules[0][1], "&&")) {
-								results.FingerPrint = append(results.FingerPrint, finger.Name)
-								break
-							}
-						}
-					}
-				}
-
-				// 1&&2&&(3||4)
-				if strings.Contains(bracketRule, "||") {
-					for _, rule := range strings.Split(finger.Key, "&&") {
-						var i int
-						if strings.Contains(rule, "||") {
-							// remove bracket
-							for _, _rule := range strings.Split(bracketRules[0][1], "||") {
-								if checkRule(_rule, response) {
-									i += 1
-									break
-								}
-							}
-						}
-
-						if checkRule(rule, response) {
-							i += 1
-						}
-
-						if i == len(strings.Split(finger.Key, "&&")) {
-							results.FingerPrint = append(results.FingerPrint, finger.Name)
-						}
-					}
-				}
-			}
-		}
-
-		// md5 hash
-		for _, hash := range finger.Path {
-			if hash.Url != "" {
-				var url string
-				if "/" != response.Url[len(response.Url) - 1:] {
-					url = fmt.Sprintf("%s/", response.Url)
-				}
-
-				url = fmt.Sprintf("%s%s", url, hash.Url)
+// rawResponse is a fetched page before any decoding but the
+// Content-Encoding. url is where HTTP redirects ended.
+type rawResponse struct {
+	url    string
+	status int
+	header http.Header
+	body   []byte
+}
 
-				var insecureSkipVerify bool
-				if strings.Contains(url, "https") {
-					insecureSkipVerify = true
-				}
+// scanTransport is shared by every fetch so connections and DNS answers are
+// reused across URLs and path probes. Certificates are never verified:
+// scanned hosts often have self-signed ones, and an http URL may redirect to
+// https.
+var scanTransport = requests.NewTransport(requests.TransportConfig{Insecure: true})
 
-				body, _, _, _, err := newHTTPClient(url, insecureSkipVerify, 5)
-				if err != nil {
-					return Results{}, err
-				}
+type transportKey struct{}
 
-				//if statusCode != 200 {
-				//	return Results{}, errors.New(fmt.Sprintf("http status code %d", statusCode))
-				//}
+// withTransport makes every fetch made with ctx go through transport instead
+// of scanTransport.
+func withTransport(ctx context.Context, transport http.RoundTripper) context.Context {
+	return context.WithValue(ctx, transportKey{}, transport)
+}
 
-				bodyB := []byte(body)
-				m := md5.New()
-				m.Write(bodyB)
-				if hex.EncodeToString(m.Sum(nil)) == hash.Hash {
-					results.FingerPrint = append(results.FingerPrint, finger.Name)
-				}
-			}
-		}
+func contextTransport(ctx context.Context) http.RoundTripper {
+	if transport, ok := ctx.Value(transportKey{}).(http.RoundTripper); ok {
+		return transport
 	}
-	return results, nil
+	return scanTransport
 }
 
-func newHTTPClient(url string, insecureSkipVerify bool, timeout int) (string, int, string, http.Header, error) {
-	var title, body string
-
+// fetchRaw GETs url and returns the decompressed body, read up to limit bytes
+// when limit is positive.
+func fetchRaw(ctx context.Context, url string, timeout int, limit int64) (*rawResponse, error) {
+	transport := contextTransport(ctx)
 	client := &http.Client{
-		Timeout: time.Second * time.Duration(timeout),
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
-		},
+		Timeout:   time.Second * time.Duration(timeout),
+		Transport: transport,
+	}
+	// limited per request, so that redirect hops count too
+	if limiter := contextLimiter(ctx); limiter != nil {
+		client.Transport = limiter.Transport(transport)
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return "", 0, "", nil, err
+		return nil, err
 	}
 
 	userAgent := browser.Random()
 	req.Header.Set("User-Agent", userAgent)
+	// asked for explicitly so that deflate is accepted too, the transport
+	// then leaves decompression to us
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		// fmt.Println("失败: ", url, err.Error())
-		return "", 0, "", nil, err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	bodyB, err := ioutil.ReadAll(resp.Body)
+	reader, err := decodeContent(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		reader = io.LimitReader(reader, limit)
+	}
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return "", 0, "", nil, err
+		return nil, err
 	}
 
-	body = string(bodyB)
+	return &rawResponse{
+		url:    resp.Request.URL.String(),
+		status: resp.StatusCode,
+		header: resp.Header,
+		body:   body,
+	}, nil
+}
 
-	re, errRe := regexp.Compile(`<title>(.*?)</title>`)
-	if errRe != nil {
-		title = ""
-	} else {
-		s := re.FindAllStringSubmatch(body, -1)
-		if s != nil {
-			if s[0] != nil {
-				title = s[0][1]
-			}
-		}
-	}
+var (
+	enginesMu sync.Mutex
+	engines   = make(map[string]*FingerprintEngine)
+)
 
-	var (
-		charset string
-		codeRe  *regexp.Regexp
-	)
-	codeRe, errRe = regexp.Compile(`charset=(.*?)["|']`)
-	if strings.Contains(body, `charset=["|']`) {
-		codeRe, errRe = regexp.Compile(`charset="(.*?)["|']`)
-	}
-	if errRe != nil {
-		charset = "utf-8"
-	} else {
-		charsetByte := codeRe.FindAllStringSubmatch(body, -1)
-		if charsetByte != nil {
-			if charsetByte[0] != nil {
-				charset = charsetByte[0][1]
-			}
-		}
-	}
+// loadEngine returns the engine for the database file name, compiling it on
+// first use only.
+func loadEngine(name string) (*FingerprintEngine, error) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
 
-	switch strings.ToLower(charset) {
-	case strings.ToLower("GB2312"), strings.ToLower("Big5"), strings.ToLower("GB18030"), strings.ToLower("GBK"):
-		charset = "GBK"
-	default:
-		charset = "utf-8"
+	if engine, ok := engines[name]; ok {
+		return engine, nil
 	}
 
-	if strings.ToLower(charset) != "utf-8" {
-		decoder := mahonia.NewDecoder(charset)
-		title = decoder.ConvertString(title)
-		body = decoder.ConvertString(string(bodyB))
+	engine, err := LoadFingerprintEngine(name)
+	if ruleErrs, ok := err.(RuleErrors); ok {
+		for _, ruleErr := range ruleErrs {
+			log.Printf("fingerscan: skip %v\n", ruleErr)
+		}
+	} else if err != nil {
+		return nil, err
 	}
 
-	return body, resp.StatusCode, title, resp.Header, nil
+	engines[name] = engine
+	return engine, nil
 }
 
 func WebMain(url, name string, timeout int) (Results, error) {
-	fingerArgs, err := initFingerprintFile(name)
-	if err != nil {
-		return Results{}, err
-	}
-
-	response, err := sendRequest(url, timeout)
-	if err != nil {
-		return Results{}, err
-	}
-
-	results, err := identifyResponse(fingerArgs, response)
+	engine, err := loadEngine(name)
 	if err != nil {
 		return Results{}, err
 	}
 
-	return results, nil
+	return engine.Scan(context.Background(), url, timeout)
 }
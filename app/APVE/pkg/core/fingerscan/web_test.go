@@ -1 +1,1376 @@
 package fingerscan
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axgle/mahonia"
+
+	"heaven/app/APVE/pkg/common/requests"
+)
+
+const fingerDB = "../../../../../data/fingerData/Hfinger.json"
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		keys string
+		want string
+	}{
+		{`body="a"`, `body="a"`},
+		{`body="a" || body="b" && title="c"`, `(body="a" || (body="b" && title="c"))`},
+		{`(body="a" || body="b") && (title="c" || header="d")`, `((body="a" || body="b") && (title="c" || header="d"))`},
+		{`((body="a" && (title="b" || title="c")))`, `(body="a" && (title="b" || title="c"))`},
+		{`!(body="a") && body!="b"`, `(!body="a" && body!="b")`},
+		{`title=="Everything"`, `title=="Everything"`},
+		{`body="x && y || z)"`, `body="x && y || z)"`},
+		{`(body="f(x)")`, `body="f(x)"`},
+		{`body="<div class="login">"||title="x"`, `(body="<div class=\"login\">" || title="x")`},
+		{`body="say \"hi\" || bye"`, `body="say \"hi\" || bye"`},
+		{`header=webcamXP||title=webcamXP`, `(header="webcamXP" || title="webcamXP")`},
+	}
+
+	for _, tt := range tests {
+		rule, err := parseRule(tt.keys)
+		if err != nil {
+			t.Errorf("parseRule(%s): %v", tt.keys, err)
+			continue
+		}
+		if rule.String() != tt.want {
+			t.Errorf("parseRule(%s) = %s, want %s", tt.keys, rule, tt.want)
+		}
+	}
+}
+
+func TestParseRuleError(t *testing.T) {
+	for _, keys := range []string{
+		``,
+		`body=`,
+		`body="a`,
+		`(body="a"`,
+		`body="a")`,
+		`body="a" &&`,
+		`body~"a"`,
+		`heaer="a"`,
+		`body=a title="b"`,
+	} {
+		if rule, err := parseRule(keys); err == nil {
+			t.Errorf("parseRule(%s) = %s, want error", keys, rule)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	response := Response{
+		Title: "Everything",
+		Body:  `<html><div class="login">Powered by Acme CMS</div></html>`,
+		Header: http.Header{
+			"Server":       {"Acme/1.0"},
+			"X-Powered-By": {"PHP/7.4"},
+		},
+	}
+
+	tests := []struct {
+		keys string
+		want bool
+	}{
+		{`body="acme cms"`, true},
+		{`body="nope" || (title="every" && header="acme")`, true},
+		{`body="nope" || title="every" && header="nope"`, false},
+		{`(body="nope" || title="every") && header="php/7"`, true},
+		{`header="X-Powered-By: PHP"`, true},
+		{`title=="everything"`, true},
+		{`title=="every"`, false},
+		{`header=="acme/1.0"`, true},
+		{`body!="nope" && !(title="nothing")`, true},
+		{`!body="login"`, false},
+		{`body="<div class="login">"`, true},
+	}
+
+	for _, tt := range tests {
+		rule, err := parseRule(tt.keys)
+		if err != nil {
+			t.Fatalf("parseRule(%s): %v", tt.keys, err)
+		}
+		if got := rule.match(newTarget(response)); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestInitFingerprintFile(t *testing.T) {
+	fingerprints, err := initFingerprintFile(fingerDB)
+	if ruleErrs, ok := err.(RuleErrors); ok {
+		for _, ruleErr := range ruleErrs {
+			t.Error(ruleErr)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) == 0 {
+		t.Fatal("no fingerprints loaded")
+	}
+}
+
+func TestIdentifyServerHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "EPSON-HTTP/1.0")
+		_, _ = w.Write([]byte("<html><title>Printer</title></html>"))
+	}))
+	defer ts.Close()
+
+	engine, err := LoadFingerprintEngine(fingerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := sendRequest(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := engine.Identify(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFinger(results, "epson打印机") {
+		t.Errorf("got %v, want epson打印机", results.FingerPrint)
+	}
+}
+
+func TestIdentifyRuleFields(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "TornadoServer/6.1")
+		w.Header().Set("X-Backend", "Splunkd")
+		_, _ = w.Write([]byte("<title>Flower</title> Celery monitor"))
+	}))
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	engine, err := NewFingerprintEngine([]FingerArg{
+		{Id: 1, Name: "celery", Key: `server="TornadoServer"&&body="Celery"`},
+		{Id: 2, Name: "splunk", Key: `server=Splunkd`},
+		{Id: 3, Name: "tornado-exact", Key: `server=="tornadoserver/6.1"`},
+		{Id: 4, Name: "web", Key: `type="subdomain" && protocol=http && port=` + port},
+		{Id: 5, Name: "service", Key: `type="service"`},
+		{Id: 6, Name: "ftp", Key: `protocol=ftp && banner="vsftpd"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := sendRequest(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := engine.Identify(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"celery", "tornado-exact", "web"}
+	if !reflect.DeepEqual(results.FingerPrint, want) {
+		t.Errorf("got %v, want %v", results.FingerPrint, want)
+	}
+
+	banner := Response{Url: "ftp://127.0.0.1:2121", Protocol: "ftp", Banner: "220 (vsFTPd 3.0.3)"}
+	results, err = engine.Identify(banner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"service", "ftp"}
+	if !reflect.DeepEqual(results.FingerPrint, want) {
+		t.Errorf("got %v, want %v", results.FingerPrint, want)
+	}
+}
+
+func TestACMatcher(t *testing.T) {
+	patterns := []string{"he", "she", "his", "hers", "router", "verizon router", "zon", "x"}
+	m := newACMatcher(patterns)
+	hits := make([]bool, len(patterns))
+	m.scan("ushers at the verizon router", hits)
+
+	want := []bool{true, true, false, true, true, true, true, false}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+}
+
+// the prefilter must never drop a fingerprint that the full evaluation matches
+func TestEngineMatchesFullScan(t *testing.T) {
+	fingerprints, err := initFingerprintFile(fingerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newFingerprintEngine(fingerprints)
+
+	responses := []Response{
+		sampleResponse(),
+		{Url: "http://127.0.0.1/", Title: "Kibana", Header: http.Header{"Kbn-Name": {"kibana"}}},
+		{Url: "http://127.0.0.1/", Title: "Everything", Body: "<img src=everything.png>"},
+		{Url: "http://127.0.0.1/", Body: "<h1>BEA WebLogic Server From RFC 2068 Hypertext Transfer Protocol"},
+		{Url: "ftp://127.0.0.1:21", Protocol: "ftp", Banner: "220 ProFTPD 1.3.5 Server"},
+		{Url: "http://127.0.0.1/"},
+	}
+	for _, fingerprint := range fingerprints[:200] {
+		for _, literal := range ruleLiterals(fingerprint.rule, nil) {
+			responses = append(responses, Response{Url: "http://127.0.0.1/", Body: literal, Title: literal})
+		}
+	}
+
+	for _, response := range responses {
+		t1 := newTarget(response)
+		var want []string
+		for _, finger := range fingerprints {
+			if finger.rule.match(t1) {
+				want = append(want, finger.Name)
+			}
+		}
+
+		results, err := engine.Identify(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(want) == 0 && len(results.FingerPrint) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(results.FingerPrint, want) {
+			t.Errorf("%.40q: engine %v, full scan %v", response.Body, results.FingerPrint, want)
+		}
+	}
+}
+
+func TestEngineConcurrent(t *testing.T) {
+	engine, err := LoadFingerprintEngine(fingerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := engine.Identify(sampleResponse())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				got, _ := engine.Identify(sampleResponse())
+				// only the timing may differ between runs
+				got.ScannedAt, got.MatchTime = want.ScannedAt, want.MatchTime
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkIdentifyPerURL is what WebMain did before the engine: load and
+// compile the whole database for every response.
+func BenchmarkIdentifyPerURL(b *testing.B) {
+	response := sampleResponse()
+	for i := 0; i < b.N; i++ {
+		engine, err := LoadFingerprintEngine(fingerDB)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = engine.Identify(response)
+	}
+}
+
+func BenchmarkEngineIdentify(b *testing.B) {
+	engine, err := LoadFingerprintEngine(fingerDB)
+	if err != nil {
+		b.Fatal(err)
+	}
+	response := sampleResponse()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = engine.Identify(response)
+	}
+}
+
+func BenchmarkFullScan(b *testing.B) {
+	fingerprints, err := initFingerprintFile(fingerDB)
+	if err != nil {
+		b.Fatal(err)
+	}
+	response := sampleResponse()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := newTarget(response)
+		for _, finger := range fingerprints {
+			finger.rule.match(t)
+		}
+	}
+}
+
+func TestScanBatch(t *testing.T) {
+	var inflight, maxInflight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte("<title>Acme</title>"))
+	}))
+	defer ts.Close()
+
+	engine, err := NewFingerprintEngine([]FingerArg{{Id: 1, Name: "acme", Key: `title="acme"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []string{ts.URL, ts.URL + "/", strings.ToUpper(ts.URL[:4]) + ts.URL[4:]}
+	for i := 0; i < 10; i++ {
+		targets = append(targets, fmt.Sprintf("%s/app%d", ts.URL, i))
+	}
+	targets = append(targets, "http://127.0.0.1:1/")
+
+	batch := engine.ScanBatch(context.Background(), targets, BatchOptions{Workers: 8, PerHost: 3, RateLimit: 200, Timeout: 5})
+	var matched int
+	for result := range batch.Results() {
+		if result.Err == nil && hasFinger(result.Results, "acme") {
+			matched++
+		}
+	}
+	summary := batch.Wait()
+
+	if matched != 11 {
+		t.Errorf("matched %d targets, want 11", matched)
+	}
+	if summary.Total != 14 || summary.Duplicates != 2 || summary.Done != 11 || summary.Failed != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+	if maxInflight > 3 {
+		t.Errorf("%d concurrent requests to one host, want at most 3", maxInflight)
+	}
+}
+
+func TestScanBatchRateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	engine, _ := NewFingerprintEngine(nil)
+	var targets []string
+	for i := 0; i < 6; i++ {
+		targets = append(targets, fmt.Sprintf("%s/%d", ts.URL, i))
+	}
+
+	start := time.Now()
+	batch := engine.ScanBatch(context.Background(), targets, BatchOptions{PerHost: 6, RateLimit: 20})
+	for range batch.Results() {
+	}
+	// six requests at 20/s need at least 5 intervals of 50ms
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("batch took %v, want at least 250ms", elapsed)
+	}
+}
+
+func TestScanBatchLimitsEveryRequest(t *testing.T) {
+	var requests, inflight, maxInflight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if !strings.HasSuffix(r.URL.Path, "/home") && !strings.HasSuffix(r.URL.Path, "/probe.js") {
+			http.Redirect(w, r, r.URL.Path+"/home", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	// the path probe and the redirect are requests of their own
+	engine, err := NewFingerprintEngine([]FingerArg{{Id: 1, Name: "probe", Key: `title="none"`, Path: []UrlHash{{Url: "/probe.js", Hash: "0"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for i := 0; i < 3; i++ {
+		targets = append(targets, fmt.Sprintf("%s/%d", ts.URL, i))
+	}
+
+	start := time.Now()
+	batch := engine.ScanBatch(context.Background(), targets, BatchOptions{Workers: 3, PerHost: 1, RateLimit: 40})
+	for range batch.Results() {
+	}
+	elapsed := time.Since(start)
+	if n := atomic.LoadInt32(&requests); n != 9 {
+		t.Fatalf("%d requests, want 9", n)
+	}
+	// nine requests at 40/s need at least 8 intervals of 25ms
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("batch took %v, want at least 200ms", elapsed)
+	}
+	if maxInflight > 1 {
+		t.Errorf("%d concurrent requests to one host, want at most 1", maxInflight)
+	}
+}
+
+func TestScanBatchCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	engine, _ := NewFingerprintEngine(nil)
+	targets := make(chan string)
+	go func() {
+		for i := 0; i < 100; i++ {
+			targets <- fmt.Sprintf("%s/%d", ts.URL, i)
+		}
+		close(targets)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	batch := engine.ScanStream(ctx, targets, BatchOptions{Workers: 4, PerHost: 4})
+	for result := range batch.Results() {
+		t.Errorf("unexpected result %+v", result)
+	}
+	summary := batch.Wait()
+	if summary.Canceled == 0 || summary.Done != 0 {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestScanBatchConsumerStops(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	engine, _ := NewFingerprintEngine(nil)
+	var targets []string
+	for i := 0; i < 20; i++ {
+		targets = append(targets, fmt.Sprintf("%s/%d", ts.URL, i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	batch := engine.ScanBatch(ctx, targets, BatchOptions{Workers: 4})
+	<-batch.Results()
+	// the workers must not block on results nobody reads
+	cancel()
+
+	done := make(chan BatchSummary)
+	go func() { done <- batch.Wait() }()
+	select {
+	case summary := <-done:
+		if summary.Canceled == 0 {
+			t.Errorf("summary = %+v", summary)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after the consumer stopped reading")
+	}
+}
+
+func TestScanBatchTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(3 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	engine, _ := NewFingerprintEngine(nil)
+	batch := engine.ScanBatch(context.Background(), []string{ts.URL}, BatchOptions{Timeout: 1})
+	for range batch.Results() {
+	}
+	if summary := batch.Wait(); summary.Timeouts != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestFaviconHash(t *testing.T) {
+	var large []byte
+	for i := 0; i < 3; i++ {
+		for c := 0; c < 256; c++ {
+			large = append(large, byte(c))
+		}
+	}
+	// reference values from Python mmh3.hash(codecs.encode(data, "base64"))
+	if got := faviconHash(large); got != "1836528006" {
+		t.Errorf("faviconHash(large) = %s", got)
+	}
+	if got := faviconHash([]byte("hello favicon")); got != "508473084" {
+		t.Errorf("faviconHash(short) = %s", got)
+	}
+}
+
+func TestFaviconURLs(t *testing.T) {
+	body := `<head><LINK REL="shortcut icon" href='/static/a.ico'><link href=b.png rel=icon>
+		<link rel="stylesheet" href="/style.css"><link rel="apple-touch-icon" href="https://cdn.example.com/c.png"></head>`
+	got := faviconURLs("http://example.com/app/", body)
+	want := []string{
+		"http://example.com/static/a.ico",
+		"http://example.com/app/b.png",
+		"https://cdn.example.com/c.png",
+		"http://example.com/favicon.ico",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("faviconURLs = %v, want %v", got, want)
+	}
+}
+
+func TestIdentifyProbes(t *testing.T) {
+	icon := []byte("\x00\x00\x01\x00fake icon")
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			_, _ = w.Write([]byte(`<link rel="icon" href="/img/logo.ico">`))
+		case "/img/logo.ico":
+			_, _ = w.Write(icon)
+		case "/static/app.js":
+			_, _ = w.Write([]byte("app"))
+		case "/broken":
+			// a malformed reply rather than a bare close: fetches share a
+			// keep-alive transport, and net/http silently resends a GET whose
+			// reused connection closes before any reply, so a bare close would
+			// reach this handler twice
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			_, _ = conn.Write([]byte("garbage\r\n\r\n"))
+			_ = conn.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	engine, err := NewFingerprintEngine([]FingerArg{
+		{Id: 1, Name: "icon-mmh3", Key: "icon_hash=" + faviconHash(icon)},
+		{Id: 2, Name: "icon-md5", Key: `icon_md5="` + md5Hex(icon) + `"`},
+		{Id: 3, Name: "icon-other", Key: `icon_hash="12345"`},
+		{Id: 4, Name: "broken", Key: `body="never"`, Path: []UrlHash{{Url: "broken", Hash: "x"}}},
+		{Id: 5, Name: "app-a", Key: `body="never"`, Path: []UrlHash{{Url: "static/app.js", Hash: md5Hex([]byte("app"))}}},
+		{Id: 6, Name: "app-b", Key: `body="never"`, Path: []UrlHash{{Url: "/static/app.js", Hash: md5Hex([]byte("app"))}}},
+		{Id: 7, Name: "missing", Key: `body="never"`, Path: []UrlHash{{Url: "missing.js", Hash: md5Hex([]byte("404 page not found\n"))}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := engine.Scan(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"icon-mmh3", "icon-md5", "app-a", "app-b"}
+	if !reflect.DeepEqual(results.FingerPrint, want) {
+		t.Errorf("got %v, want %v", results.FingerPrint, want)
+	}
+	for path, n := range hits {
+		if n != 1 && path != "/" {
+			t.Errorf("%s fetched %d times", path, n)
+		}
+	}
+	if hits["/favicon.ico"] != 1 {
+		t.Errorf("/favicon.ico fetched %d times, want 1", hits["/favicon.ico"])
+	}
+}
+
+func TestIdentifyVersions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
+			w.Header().Set("X-Powered-By", "PHP/7.4.3")
+			_, _ = w.Write([]byte(`<html><head><title>Jenkins [2.319]</title></head>` +
+				`<body><div class="footer">Powered by WordPress 5.8.1</div></body></html>`))
+		case "/VERSION":
+			_, _ = w.Write([]byte("release 3.2.1\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	engine, err := NewFingerprintEngine([]FingerArg{
+		{Id: 1, Name: "apache", Key: `server="apache"`,
+			Versions: []VersionArg{{Part: "server", Regex: `Apache/([\d.]+)`}}},
+		{Id: 2, Name: "php", Key: `header="x-powered-by: php"`, Version: `PHP/([\d.]+)`},
+		{Id: 3, Name: "jenkins", Key: `title="jenkins"`,
+			Versions: []VersionArg{{Part: "title", Regex: `\[(\d[\d.]*)\]`}}},
+		{Id: 4, Name: "wordpress", Key: `body="powered by wordpress"`,
+			Versions: []VersionArg{{Part: "body", Regex: `(?i)wordpress (?P<v>[\d.]+)`, Group: 1}}},
+		{Id: 5, Name: "probed", Key: `title="jenkins" && body!="nginx"`,
+			Versions: []VersionArg{
+				{Part: "path", Path: "missing", Regex: `(.+)`},
+				{Part: "path", Path: "VERSION", Regex: `release ([\d.]+)`},
+			}},
+		{Id: 6, Name: "unversioned", Key: `body="footer"`,
+			Versions: []VersionArg{{Part: "body", Regex: `v(\d+)`}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := engine.Scan(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Match{
+		"apache":      {Id: 1, Name: "apache", Version: "2.4.41", Rule: `server="apache"`, Evidence: "server: Apache/2.4.41 (Ubuntu)"},
+		"php":         {Id: 2, Name: "php", Version: "7.4.3", Rule: `header="x-powered-by: php"`},
+		"jenkins":     {Id: 3, Name: "jenkins", Version: "2.319", Rule: `title="jenkins"`, Evidence: "title: Jenkins [2.319]"},
+		"wordpress":   {Id: 4, Name: "wordpress", Version: "5.8.1", Rule: `body="powered by wordpress"`},
+		"probed":      {Id: 5, Name: "probed", Version: "3.2.1", Rule: `title="jenkins" && body!="nginx"`, Evidence: "title: Jenkins [2.319]"},
+		"unversioned": {Id: 6, Name: "unversioned", Rule: `body="footer"`},
+	}
+	if len(results.Matches) != len(want) || len(results.FingerPrint) != len(want) {
+		t.Fatalf("got %v, want %d matches", results.Matches, len(want))
+	}
+	for i, got := range results.Matches {
+		if results.FingerPrint[i] != got.Name {
+			t.Errorf("FingerPrint[%d] = %q, Matches[%d].Name = %q", i, results.FingerPrint[i], i, got.Name)
+		}
+		w, ok := want[got.Name]
+		if !ok {
+			t.Errorf("unexpected match %v", got)
+			continue
+		}
+		if got.Id != w.Id || got.Version != w.Version || got.Rule != w.Rule {
+			t.Errorf("got %+v, want %+v", got, w)
+		}
+		if w.Evidence != "" && got.Evidence != w.Evidence {
+			t.Errorf("%s: evidence %q, want %q", got.Name, got.Evidence, w.Evidence)
+		}
+		if got.Evidence == "" {
+			t.Errorf("%s: no evidence", got.Name)
+		}
+	}
+	if e := results.Matches[1].Evidence; !strings.Contains(e, "X-Powered-By: PHP/7.4.3") {
+		t.Errorf("php evidence %q does not quote the header", e)
+	}
+}
+
+func TestCompileVersionsError(t *testing.T) {
+	for _, v := range []VersionArg{
+		{Part: "cookie", Regex: `(.*)`},
+		{Part: "path", Regex: `(.*)`},
+		{Part: "body", Regex: `([`},
+		{Part: "body", Regex: `(a)`, Group: 2},
+	} {
+		if _, err := compileVersions(FingerArg{Versions: []VersionArg{v}}); err == nil {
+			t.Errorf("%+v: expected an error", v)
+		}
+	}
+
+	_, err := NewFingerprintEngine([]FingerArg{{Id: 1, Name: "bad", Key: `body="a"`, Version: `(`}})
+	var ruleErrs RuleErrors
+	if !errors.As(err, &ruleErrs) || len(ruleErrs) != 1 || ruleErrs[0].Id != 1 {
+		t.Errorf("got %v, want one RuleError for id 1", err)
+	}
+}
+
+func TestSendRequestNormalize(t *testing.T) {
+	gbk := mahonia.NewEncoder("GBK").ConvertString
+	big5 := mahonia.NewEncoder("Big5").ConvertString
+	gzipped := func(data string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		_, _ = zw.Write([]byte(data))
+		_ = zw.Close()
+		return b.Bytes()
+	}
+	deflated := func(data string, wrap bool) []byte {
+		var b bytes.Buffer
+		var w io.WriteCloser
+		if wrap {
+			w = zlib.NewWriter(&b)
+		} else {
+			w, _ = flate.NewWriter(&b, flate.DefaultCompression)
+		}
+		_, _ = w.Write([]byte(data))
+		_ = w.Close()
+		return b.Bytes()
+	}
+
+	pages := map[string]struct {
+		header http.Header
+		body   []byte
+	}{
+		"/gzip-gbk": {
+			http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"text/html; charset=GBK"}},
+			gzipped(gbk("<html><head><title id=\"t\">\n  管理 平台 &amp; 登录\n</title></head><body>欢迎</body></html>")),
+		},
+		"/zlib": {
+			http.Header{"Content-Encoding": {"deflate"}},
+			deflated("<title>zlib</title>", true),
+		},
+		"/deflate": {
+			http.Header{"Content-Encoding": {"deflate"}},
+			deflated("<title>raw deflate</title>", false),
+		},
+		"/big5": {
+			http.Header{"Content-Type": {"text/html"}},
+			[]byte(big5(`<meta http-equiv="Content-Type" content="text/html; charset=big5"><title>繁體中文</title>`)),
+		},
+		"/meta-charset": {
+			http.Header{"Content-Type": {"text/html"}},
+			[]byte(gbk(`<meta charset="gb2312"><svg><title>icon</title></svg><title>简体</title>`)),
+		},
+		"/undeclared": {
+			http.Header{"Content-Type": {"text/html"}},
+			[]byte(gbk(`<title>路由器</title>`)),
+		},
+		"/bom": {
+			nil,
+			append([]byte{0xff, 0xfe}, []byte(mahonia.NewEncoder("UTF-16LE").ConvertString("<title>bom</title>"))...),
+		},
+		"/refresh":  {nil, []byte(`<meta http-equiv="refresh" content="0; URL='/js'">`)},
+		"/js":       {nil, []byte(`<script>window.location.href = "final?x=1";</script>`)},
+		"/final":    {nil, []byte(`<title>Final</title><script>function go() { location.href = "/other"; }</script>` + strings.Repeat(" ", maxScriptRedirectPage))},
+		"/loop-a":   {nil, []byte(`<meta http-equiv="refresh" content="1;url=/loop-b">`)},
+		"/loop-b":   {nil, []byte(`<script>location.replace('/loop-a')</script>`)},
+		"/to-error": {nil, []byte(`<title>landing</title><meta http-equiv="refresh" content="0;url=http://127.0.0.1:1/">`)},
+		"/trs":      {nil, []byte(`<html><meta http-equiv="refresh" content="0;URL=/wcm"></html>`)},
+		"/wcm":      {nil, []byte(`<title>WCM</title>`)},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/http-redirect" {
+			http.Redirect(w, r, "/refresh", http.StatusFound)
+			return
+		}
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for name, values := range page.header {
+			w.Header()[name] = values
+		}
+		_, _ = w.Write(page.body)
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		path, title, charset, final, body string
+	}{
+		{"/gzip-gbk", "管理 平台 & 登录", "GBK", "/gzip-gbk", "欢迎"},
+		{"/zlib", "zlib", "UTF-8", "/zlib", ""},
+		{"/deflate", "raw deflate", "UTF-8", "/deflate", ""},
+		{"/big5", "繁體中文", "Big5", "/big5", ""},
+		{"/meta-charset", "简体", "GBK", "/meta-charset", ""},
+		{"/undeclared", "路由器", "GB18030", "/undeclared", ""},
+		{"/bom", "bom", "UTF-16LE", "/bom", ""},
+		{"/http-redirect", "Final", "UTF-8", "/final?x=1", ""},
+		{"/loop-a", "", "UTF-8", "/loop-b", ""},
+		{"/to-error", "landing", "UTF-8", "/to-error", ""},
+	} {
+		response, err := sendRequest(context.Background(), ts.URL+test.path, 5)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if response.Url != ts.URL+test.path {
+			t.Errorf("%s: url %q changed", test.path, response.Url)
+		}
+		if response.Title != test.title || response.Charset != test.charset || response.FinalUrl != ts.URL+test.final {
+			t.Errorf("%s: got title %q charset %s final %s, want %q %s %s",
+				test.path, response.Title, response.Charset, response.FinalUrl, test.title, test.charset, ts.URL+test.final)
+		}
+		if !strings.Contains(response.Body, test.body) {
+			t.Errorf("%s: body %q does not contain %q", test.path, response.Body, test.body)
+		}
+		if redirected := test.path != test.final; redirected != (response.Landing != nil) {
+			t.Errorf("%s: landing %+v", test.path, response.Landing)
+		}
+	}
+	if response, _ := sendRequest(context.Background(), ts.URL+"/http-redirect", 5); response.Landing == nil ||
+		response.Landing.FinalUrl != ts.URL+"/refresh" || !strings.Contains(response.Landing.Body, "URL='/js'") {
+		t.Errorf("landing %+v", response.Landing)
+	}
+
+	engine, err := NewFingerprintEngine([]FingerArg{{Id: 1, Name: "final", Key: `title="final"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := engine.Scan(context.Background(), ts.URL+"/refresh", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.FinalUrl != ts.URL+"/final?x=1" || !hasFinger(results, "final") {
+		t.Errorf("got %+v", results)
+	}
+
+	// rules written for the redirect page still match once it is followed
+	engine, err = NewFingerprintEngine([]FingerArg{
+		{Id: 1621, Name: "trs_wcm", Key: `body="/wcm/app/js" || body="0;URL=/wcm"`},
+		{Id: 2, Name: "wcm", Key: `title="WCM"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = engine.Scan(context.Background(), ts.URL+"/trs", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.FinalUrl != ts.URL+"/wcm" || !hasFinger(results, "trs_wcm") || !hasFinger(results, "wcm") {
+		t.Errorf("got %+v", results)
+	}
+}
+
+func TestScanHARReplay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := `<meta http-equiv="refresh" content="0;url=/login">`
+		if r.URL.Path == "/login" {
+			page = `<title>Console Login</title>`
+		}
+		// compressed, as fetchRaw asks for it itself
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, page)
+		_ = gz.Close()
+	}))
+	engine, err := NewFingerprintEngine([]FingerArg{
+		{Id: 1, Name: "console", Key: `title="Console Login"`},
+		{Id: 2, Name: "redirect", Key: `body="url=/login"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := requests.NewHARRecorder()
+	recorded, err := engine.WithTransport(recorder.Transport(nil)).Scan(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+	replay, err := requests.NewHARReplay(recorder.HAR())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := engine.WithTransport(replay).Scan(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"console", "redirect"}
+	if !reflect.DeepEqual(recorded.FingerPrint, want) || !reflect.DeepEqual(replayed.FingerPrint, want) {
+		t.Errorf("recorded %v, replayed %v, want %v", recorded.FingerPrint, replayed.FingerPrint, want)
+	}
+	if _, err := engine.Scan(context.Background(), ts.URL, 1); err == nil {
+		t.Error("engine without the replay transport reached the closed server")
+	}
+}
+
+func TestHTMLTitle(t *testing.T) {
+	for body, want := range map[string]string{
+		`<TITLE lang="en">  Multi
+			line   </TITLE>`: "Multi line",
+		`<title>a &lt;b&gt;</title>`:             "a <b>",
+		`<svg><title>x</title></svg>`:            "",
+		`<p>no title</p>`:                        "",
+		`<title>unclosed`:                        "unclosed",
+		`<head><title></title></head><title>2nd`: "",
+	} {
+		if got := htmlTitle(body); got != want {
+			t.Errorf("htmlTitle(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestScanResultFields(t *testing.T) {
+	body := `<title>Status Page</title><p>hello-app</p>`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/home", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Server", "hello/1.0")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	engine, err := NewFingerprintEngine([]FingerArg{{Id: 7, Name: "hello", Key: `body="hello-app"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	results, err := engine.Scan(context.Background(), ts.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Url != ts.URL || results.FinalUrl != ts.URL+"/home" || results.StatusCode != http.StatusAccepted ||
+		results.Title != "Status Page" || results.Server != "hello/1.0" ||
+		results.ContentLength != int64(len(body)) || results.Charset != "UTF-8" {
+		t.Errorf("got %+v", results)
+	}
+	if results.ScannedAt.Before(before) || results.FetchTime <= 0 || results.MatchTime <= 0 {
+		t.Errorf("timing not recorded: %v %v %v", results.ScannedAt, results.FetchTime, results.MatchTime)
+	}
+	if len(results.Matches) != 1 || results.Matches[0].Evidence != "body: <title>Status Page</title><p>hello-app</p>" {
+		t.Errorf("got matches %+v", results.Matches)
+	}
+}
+
+func TestResultWriters(t *testing.T) {
+	scanned := time.Date(2022, 5, 1, 8, 0, 0, 0, time.UTC)
+	all := []Results{
+		{
+			Url:           "http://a.example",
+			FinalUrl:      "http://a.example/login",
+			StatusCode:    200,
+			Title:         "=HYPERLINK(\"http://evil\")",
+			Server:        "nginx",
+			ContentLength: 42,
+			Charset:       "GBK",
+			FingerPrint:   []string{"nginx", "thinkphp"},
+			Matches: []Match{
+				{Id: 1, Name: "nginx", Version: "1.20", Rule: `server="nginx"`, Evidence: "server: nginx"},
+				{Id: 2, Name: "thinkphp", Rule: `body="thinkphp"`, Evidence: "body: thinkphp, a, b"},
+			},
+			ScannedAt: scanned,
+			FetchTime: 1500 * time.Microsecond,
+			MatchTime: 250 * time.Microsecond,
+		},
+		{Url: "http://b.example", StatusCode: 404},
+	}
+
+	var jsonl bytes.Buffer
+	w := NewJSONLinesWriter(&jsonl)
+	for _, results := range all {
+		if err := w.Write(results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(jsonl.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), &jsonl)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"url":            "http://a.example",
+		"final_url":      "http://a.example/login",
+		"status_code":    200.0,
+		"title":          `=HYPERLINK("http://evil")`,
+		"content_length": 42.0,
+		"scanned_at":     "2022-05-01T08:00:00Z",
+		"fetch_ms":       1.5,
+		"match_ms":       0.25,
+	} {
+		if record[key] != want {
+			t.Errorf("%s = %v, want %v", key, record[key], want)
+		}
+	}
+	matches, _ := record["matches"].([]interface{})
+	if len(matches) != 2 || matches[0].(map[string]interface{})["version"] != "1.20" {
+		t.Errorf("got matches %v", record["matches"])
+	}
+	if !strings.Contains(lines[1], `"fingerprints":[]`) || !strings.Contains(lines[1], `"matches":[]`) {
+		t.Errorf("empty result should have empty lists: %s", lines[1])
+	}
+
+	var out bytes.Buffer
+	w = NewCSVWriter(&out)
+	for _, results := range all {
+		if err := w.Write(results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Fatalf("got rows %q", rows)
+	}
+	if rows[1][3] != `'=HYPERLINK("http://evil")` {
+		t.Errorf("formula not defused: %q", rows[1][3])
+	}
+	if rows[1][13] != "nginx" || rows[2][13] != "thinkphp" || rows[2][16] != "body: thinkphp, a, b" || rows[1][0] != rows[2][0] {
+		t.Errorf("one line per match expected, got %q", rows[1:3])
+	}
+	if rows[3][0] != "http://b.example" || rows[3][2] != "404" || rows[3][13] != "" {
+		t.Errorf("unmatched result line %q", rows[3])
+	}
+}
+
+// serveTCP runs handle for every connection to the returned address.
+func serveTCP(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestScanService(t *testing.T) {
+	defer func(wait time.Duration) { bannerWait = wait }(bannerWait)
+	bannerWait = 200 * time.Millisecond
+
+	greet := func(banner string) func(net.Conn) {
+		return func(conn net.Conn) {
+			_, _ = conn.Write([]byte(banner))
+			time.Sleep(time.Second)
+		}
+	}
+	answer := func(want, reply string) func(net.Conn) {
+		return func(conn net.Conn) {
+			buf := make([]byte, 64)
+			n, _ := conn.Read(buf)
+			if strings.HasPrefix(string(buf[:n]), want) {
+				_, _ = conn.Write([]byte(reply))
+			}
+		}
+	}
+
+	ssh := serveTCP(t, greet("SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.5\r\n"))
+	ftp := serveTCP(t, greet("220 (vsFTPd 3.0.3)\r\n"))
+	redis := serveTCP(t, answer("*1\r\n$4\r\nINFO\r\n", "$40\r\n# Server\r\nredis_version:6.0.9\r\nredis_mode:standalone\r\n"))
+	mysql := serveTCP(t, greet("\x4a\x00\x00\x00\x0a5.7.33-log\x00\x08\x00\x00\x00abcdefgh\x00"))
+	silent := serveTCP(t, answer(genericProbe, "hello from a quiet service\n"))
+	mute := serveTCP(t, func(conn net.Conn) { time.Sleep(time.Second) })
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<title>web on a raw port</title>"))
+	}))
+	defer web.Close()
+	secure := httptest.NewTLSServer(web.Config.Handler)
+	defer secure.Close()
+	hinted := httptest.NewTLSServer(web.Config.Handler)
+	defer hinted.Close()
+	hintedAddr := strings.TrimPrefix(hinted.URL, "https://")
+	_, hintedPort, _ := net.SplitHostPort(hintedAddr)
+	portProtocols[hintedPort] = "https"
+	defer delete(portProtocols, hintedPort)
+
+	engine, err := NewFingerprintEngine([]FingerArg{
+		{Id: 1, Name: "OpenSSH", Key: `protocol=ssh && banner="openssh"`,
+			Versions: []VersionArg{{Part: "banner", Regex: `OpenSSH_([\w.]+)`}}},
+		{Id: 2, Name: "vsftpd", Key: `protocol=ftp && banner="vsftpd"`,
+			Versions: []VersionArg{{Part: "banner", Regex: `vsFTPd ([\d.]+)`}}},
+		{Id: 3, Name: "Redis", Key: `protocol=redis && banner="redis_version"`,
+			Versions: []VersionArg{{Part: "banner", Regex: `redis_version:([\d.]+)`}}},
+		{Id: 4, Name: "MySQL", Key: `protocol==mysql && type=service`,
+			Versions: []VersionArg{{Part: "banner", Regex: `\\x00\n([\d.]+)`}}},
+		{Id: 5, Name: "quiet", Key: `banner="quiet service"`},
+		{Id: 6, Name: "raw-web", Key: `title="raw port"`},
+		{Id: 7, Name: "web-only", Key: `type=subdomain && title="raw port"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webAddr := strings.TrimPrefix(web.URL, "http://")
+	for _, test := range []struct {
+		target, protocol, name, version string
+	}{
+		{ssh, "ssh", "OpenSSH", "8.2p1"},
+		{"ftp://" + ftp, "ftp", "vsftpd", "3.0.3"},
+		{"redis://" + redis, "redis", "Redis", "6.0.9"},
+		{"tcp://" + mysql, "mysql", "MySQL", "5.7.33"},
+		{silent, "", "quiet", ""},
+		{webAddr, "http", "raw-web", ""},
+		// silent in plaintext, detected by a TLS handshake
+		{strings.TrimPrefix(secure.URL, "https://"), "https", "raw-web", ""},
+		// https by its port, never sent a plaintext probe
+		{hintedAddr, "https", "raw-web", ""},
+	} {
+		results, err := engine.ScanTarget(context.Background(), test.target, 5)
+		if err != nil {
+			t.Errorf("%s: %v", test.target, err)
+			continue
+		}
+		if results.Url != test.target {
+			t.Errorf("%s: url %q", test.target, results.Url)
+		}
+		if test.protocol != "" && results.Protocol != test.protocol {
+			t.Errorf("%s: protocol %q, want %q (banner %q)", test.target, results.Protocol, test.protocol, results.Banner)
+		}
+		if len(results.Matches) == 0 || results.Matches[0].Name != test.name || results.Matches[0].Version != test.version {
+			t.Errorf("%s: got %+v, want %s %s", test.target, results.Matches, test.name, test.version)
+		}
+	}
+
+	results, err := engine.ScanService(context.Background(), mute, 1)
+	if err != nil || results.Banner != "" || len(results.FingerPrint) != 0 {
+		t.Errorf("mute service: %+v, %v", results, err)
+	}
+	if _, err := engine.ScanService(context.Background(), "127.0.0.1:1", 1); err == nil {
+		t.Error("expected an error for a closed port")
+	}
+	if _, err := engine.ScanService(context.Background(), "gopher://127.0.0.1", 1); err == nil {
+		t.Error("expected an error for a scheme without a default port")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := engine.ScanService(ctx, mute, 10); err == nil || time.Since(start) > time.Second {
+		t.Errorf("canceled scan returned %v after %v", err, time.Since(start))
+	}
+}
+
+func TestIsServiceTarget(t *testing.T) {
+	for target, want := range map[string]bool{
+		"http://example.com":     false,
+		"https://example.com:22": false,
+		"example.com":            false,
+		"example.com:22":         true,
+		"10.0.0.1:3306":          true,
+		"[::1]:6379":             true,
+		"ssh://example.com":      true,
+		"tcp://10.0.0.1:9000":    true,
+	} {
+		if got := isServiceTarget(target); got != want {
+			t.Errorf("isServiceTarget(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadFingerArgs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a/native.json": `[
+			{"id": 1, "name": "nginx", "keys": "server=\"nginx\""},
+			{"id": 2, "name": "tomcat", "keys": "title=\"Apache Tomcat\""}
+		]`,
+		"a/overrides/extra.yaml": `
+- id: 2
+  name: jboss
+  keys: body="jboss"
+  versions:
+    - part: header
+      regex: 'JBoss-([\d.]+)'
+- id: 3
+  name: NGINX
+  keys: server = "NGINX"
+- id: 4
+  name: broken
+  keys: body="a" &&
+- name: Tomcat
+  keys: header="Apache-Coyote"
+`,
+		"ehole.json": `{"fingerprint": [
+			{"cms": "seeyon", "method": "keyword", "location": "body", "keyword": ["/seeyon/USER-DATA/", "login.gif"]},
+			{"cms": "icon", "method": "faviconhash", "location": "body", "keyword": ["123", "-456"]},
+			{"cms": "regex", "method": "regula", "location": "body", "keyword": ["a.*b"]}
+		]}`,
+		"wappalyzer.json": `{"technologies": {
+			"WordPress": {
+				"html": "<link rel=[\"']stylesheet[\"'] [^>]+wp-(?:content|includes)",
+				"meta": {"generator": "^WordPress ?([\\d.]+)?\\;version:\\1"},
+				"headers": {"X-Pingback": "/xmlrpc\\.php$"}
+			},
+			"PHP": {
+				"headers": {"X-Powered-By": "^php/?([\\d.]+)?\\;version:\\1"},
+				"cookies": {"PHPSESSID": ""}
+			},
+			"Opaque": {"html": "(?=x)y"}
+		}}`,
+		"bare.json":    `{"Jenkins": {"cats": [44], "headers": {"X-Jenkins": "([\\d.]+)\\;version:\\1"}}}`,
+		"package.json": `{"name": "rules", "version": "1.0.0"}`,
+		"notes.txt":    "not a rule file",
+	})
+
+	args, report, err := LoadFingerArgs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 6 {
+		t.Errorf("files %v, want 6", report.Files)
+	}
+	if len(report.Unknown) != 1 || filepath.Base(report.Unknown[0]) != "package.json" {
+		t.Errorf("unknown %v, want package.json", report.Unknown)
+	}
+	wantImported := map[string]int{FormatNative: 6, FormatEHole: 2, FormatWappalyzer: 3}
+	if !reflect.DeepEqual(report.Imported, wantImported) {
+		t.Errorf("imported %v, want %v", report.Imported, wantImported)
+	}
+
+	keys := make(map[string]string)
+	ids := make(map[int]string)
+	for _, arg := range args {
+		if other, ok := ids[arg.Id]; ok {
+			t.Errorf("id %d used by %s and %s", arg.Id, other, arg.Name)
+		}
+		ids[arg.Id] = arg.Name
+		keys[arg.Name] = arg.Key
+	}
+	wantKeys := map[string]string{
+		"nginx":     `server="nginx"`,
+		"tomcat":    `title="Apache Tomcat"`,
+		"jboss":     `body="jboss"`,
+		"Tomcat":    `header="Apache-Coyote"`,
+		"seeyon":    `body="/seeyon/USER-DATA/" && body="login.gif"`,
+		"icon":      `icon_hash="123" || icon_hash="-456"`,
+		"WordPress": `(header="x-pingback:" && header="/xmlrpc.php") || (body="<link rel=" && body="stylesheet" && body="wp-") || (body="generator" && body="WordPress")`,
+		"PHP":       `header="x-powered-by: php" || header="set-cookie: phpsessid="`,
+		"Jenkins":   `header="x-jenkins:"`,
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("got keys %v, want %v", keys, wantKeys)
+	}
+	if report.Loaded != len(args) || len(args) != len(wantKeys) {
+		t.Errorf("loaded %d, returned %d, want %d", report.Loaded, len(args), len(wantKeys))
+	}
+
+	if len(report.Duplicates) != 1 || report.Duplicates[0].Name != "NGINX" || report.Duplicates[0].Detail == "" {
+		t.Errorf("duplicates %v", report.Duplicates)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Name != "Tomcat" || report.Conflicts[0].Id == 0 ||
+		!strings.Contains(report.Conflicts[0].Detail, "id 2 ") {
+		t.Errorf("conflicts %v", report.Conflicts)
+	}
+	if len(report.IdCollisions) != 1 || report.IdCollisions[0].Name != "jboss" || ids[2] != "tomcat" {
+		t.Errorf("id collisions %v", report.IdCollisions)
+	}
+	if len(report.Skipped) != 2 {
+		t.Errorf("skipped %v, want regex and Opaque", report.Skipped)
+	}
+	if len(report.Invalid) != 1 || report.Invalid[0].Name != "broken" {
+		t.Errorf("invalid %v", report.Invalid)
+	}
+	if text := report.String(); !strings.Contains(text, "id collision") || !strings.Contains(text, "name conflict") ||
+		!strings.Contains(text, "unknown format") || !strings.Contains(text, "invalid") {
+		t.Errorf("report does not list every issue:\n%s", text)
+	}
+
+	engine, err := NewFingerprintEngine(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := engine.identify(Response{
+		Url:    "http://127.0.0.1:1/",
+		Header: http.Header{"X-Powered-By": {"PHP/7.4.3"}, "Server": {"JBoss-7.1"}},
+		Body:   `<meta name="generator" content="WordPress 5.8.1" /><p>jboss</p>`,
+	}, newProbeCache(context.Background(), "http://127.0.0.1:1/", 1))
+	versions := make(map[string]string)
+	for _, m := range results.Matches {
+		versions[m.Name] = m.Version
+	}
+	wantVersions := map[string]string{"WordPress": "5.8.1", "PHP": "7.4.3", "jboss": "7.1"}
+	if !reflect.DeepEqual(versions, wantVersions) {
+		t.Errorf("got %v, want %v", versions, wantVersions)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFingerArgs(&buf, args); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"merged/Hfinger.json": buf.String()})
+	again, report, err := LoadFingerArgs(filepath.Join(dir, "merged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf2 bytes.Buffer
+	if err := WriteFingerArgs(&buf2, again); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != buf2.String() {
+		t.Errorf("round trip changed the database:\n%s\n%s", &buf, &buf2)
+	}
+	if len(report.Duplicates)+len(report.IdCollisions)+len(report.Invalid) > 0 {
+		t.Errorf("merged database is not clean:\n%s", report)
+	}
+}
+
+func TestLoadFingerArgsError(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bad.yaml": "- id: 1\n  name: [unclosed\n"})
+	if _, _, err := LoadFingerArgs(dir); err == nil || !strings.Contains(err.Error(), "bad.yaml") {
+		t.Errorf("got %v, want an error naming bad.yaml", err)
+	}
+	writeFiles(t, dir, map[string]string{"single/package.json": `{"name": "rules"}`})
+	if _, _, err := LoadFingerArgs(filepath.Join(dir, "single", "package.json")); err == nil || !strings.Contains(err.Error(), "unknown fingerprint format") {
+		t.Errorf("got %v, want an unknown format error for a file named directly", err)
+	}
+	if _, _, err := LoadFingerArgs(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+}
+
+func sampleResponse() Response {
+	body := strings.Repeat(`<div class="content"><p>Lorem ipsum dolor sit amet, consectetur adipiscing elit.</p></div>`, 400)
+	return Response{
+		Url:   "http://127.0.0.1/",
+		Title: "Welcome to nginx!",
+		Body:  `<html><head><title>Welcome to nginx!</title><script src="/js/jquery.min.js"></script></head>` + body + `</html>`,
+		Header: http.Header{
+			"Server":       {"nginx/1.18.0"},
+			"Content-Type": {"text/html; charset=utf-8"},
+			"X-Powered-By": {"PHP/7.4.3"},
+			"Set-Cookie":   {"PHPSESSID=abc; path=/"},
+		},
+	}
+}
+
+func hasFinger(results Results, name string) bool {
+	for _, finger := range results.FingerPrint {
+		if finger == name {
+			return true
+		}
+	}
+	return false
+}
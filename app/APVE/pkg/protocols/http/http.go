@@ -3,6 +3,9 @@ package http
 type Request struct {
 	Path []string `yaml:"path,omitempty" jsonschema:"title=path(s) for the http request,description=Path(s) to send http requests to"`
 	Raw  []string `yaml:"raw,omitempty" jsonschema:"http requests in raw format,description=HTTP Requests in Raw Format"`
+	// description: |
+	//   Method is the HTTP method used with path, GET when empty.
+	Method string `yaml:"method,omitempty" jsonschema:"title=method is the http request method,description=Method is the HTTP Request Method used with path"`
 	// ID is the optional id of the request
 	ID   string `yaml:"id,omitempty" jsonschema:"title=id for the http request,description=ID for the HTTP Request"`
 	Name string `yaml:"name,omitempty" jsonschema:"title=name for the http request,description=Optional name for the HTTP Request"`
@@ -0,0 +1,177 @@
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Error is a problem in a template file. Line is 0 when the error is not
+// about a particular line, as when the file cannot be read.
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.File == "":
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	case e.Line == 0:
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors lists every problem found while loading templates.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Parse decodes and validates a template. name is the file used in errors.
+// The error is an Errors listing every problem found.
+func Parse(name string, data []byte) (*Template, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(trimBOM(data), &node); err != nil {
+		return nil, yamlErrors(name, err)
+	}
+	if len(node.Content) == 0 {
+		return nil, Errors{{File: name, Err: errors.New("empty template")}}
+	}
+	doc := node.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, Errors{{File: name, Line: doc.Line, Err: errors.New("template is not a mapping")}}
+	}
+
+	t := &Template{}
+	if err := doc.Decode(t); err != nil {
+		return nil, yamlErrors(name, err)
+	}
+	t.Path = name
+	if errs := t.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return t, nil
+}
+
+// ParseFile reads and parses one template file.
+func ParseFile(path string) (*Template, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, Errors{{File: path, Err: err}}
+	}
+	return Parse(path, data)
+}
+
+// LoadDir loads every .yaml and .yml file under dir, or dir itself when it
+// is a file, in lexical order. Templates with the same id as an earlier one
+// are rejected. Valid templates are returned even when others fail, the
+// error listing the files that did.
+func LoadDir(dir string) ([]*Template, error) {
+	files, err := templateFiles(dir)
+	if err != nil {
+		return nil, Errors{{File: dir, Err: err}}
+	}
+
+	var templates []*Template
+	var errs Errors
+	ids := make(map[string]*Template)
+	for _, file := range files {
+		t, err := ParseFile(file)
+		if err != nil {
+			errs = append(errs, err.(Errors)...)
+			continue
+		}
+		if first, ok := ids[t.ID]; ok {
+			errs = append(errs, &Error{
+				File: file,
+				Line: t.pos.at("id"),
+				Err:  fmt.Errorf("duplicate id %q, first defined in %s:%d", t.ID, first.Path, first.pos.at("id")),
+			})
+			continue
+		}
+		ids[t.ID] = t
+		templates = append(templates, t)
+	}
+	if len(errs) > 0 {
+		return templates, errs
+	}
+	return templates, nil
+}
+
+func templateFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".yaml", ".yml":
+			if !info.IsDir() {
+				files = append(files, name)
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors splits the errors of the yaml package, which put the line in
+// the message, into Errors.
+func yamlErrors(name string, err error) Errors {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	errs := make(Errors, 0, len(msgs))
+	for _, msg := range msgs {
+		e := &Error{File: name}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		}
+		e.Err = errors.New(strings.TrimPrefix(msg, "yaml: "))
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// trimBOM drops a UTF-8 byte order mark, which editors on Windows add.
+func trimBOM(data []byte) []byte {
+	return bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+}
@@ -1,6 +1,420 @@
 package templates
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
 
+	"gopkg.in/yaml.v3"
+
+	"heaven/app/APVE/pkg/protocols/http"
+)
+
+// Template is a YAML vulnerability template, as exploit/script/webmin_rce.yaml.
 type Template struct {
+	ID       string     `yaml:"id"`
+	Info     Info       `yaml:"info"`
+	Requests []*Request `yaml:"requests"`
+	// Path is the file the template was loaded from
+	Path string `yaml:"-"`
+
+	pos position
+}
+
+// Info describes the vulnerability a template checks for.
+type Info struct {
+	Name        string        `yaml:"name"`
+	Author      StringSlice   `yaml:"author"`
+	Severity    Severity      `yaml:"severity"`
+	Description string        `yaml:"description,omitempty"`
+	Reference   StringOrSlice `yaml:"reference,omitempty"`
+	Tags        StringSlice   `yaml:"tags,omitempty"`
+	// Classification is nil when the template has none
+	Classification *Classification `yaml:"classification,omitempty"`
+
+	pos position
+}
+
+// Classification identifies the vulnerability in public databases.
+type Classification struct {
+	CVSSMetrics string      `yaml:"cvss-metrics,omitempty"`
+	CVSSScore   float64     `yaml:"cvss-score,omitempty"`
+	CVEID       StringSlice `yaml:"cve-id,omitempty"`
+	CWEID       StringSlice `yaml:"cwe-id,omitempty"`
+
+	pos position
+}
+
+// Request is one entry of the requests block: the HTTP request to send and
+// the matchers deciding whether its response is vulnerable.
+type Request struct {
+	http.Request `yaml:",inline"`
+	// MatchersCondition is "and" or "or", "or" when empty
+	MatchersCondition string     `yaml:"matchers-condition,omitempty"`
+	Matchers          []*Matcher `yaml:"matchers,omitempty"`
+
+	pos position
+}
+
+// Matcher checks one part of a response.
+type Matcher struct {
+	// Type is one of word, regex, status, size, binary and dsl
+	Type string `yaml:"type"`
+	// Part is the part of the response to match, body when empty
+	Part string `yaml:"part,omitempty"`
+	// Condition is "and" or "or" between the values, "or" when empty
+	Condition string   `yaml:"condition,omitempty"`
+	Negative  bool     `yaml:"negative,omitempty"`
+	Words     []string `yaml:"words,omitempty"`
+	Regex     []string `yaml:"regex,omitempty"`
+	Status    []int    `yaml:"status,omitempty"`
+	Size      []int    `yaml:"size,omitempty"`
+	// Binary holds hex encoded bytes
+	Binary []string `yaml:"binary,omitempty"`
+	DSL    []string `yaml:"dsl,omitempty"`
+
+	pos position
+}
+
+// Severity levels, from the least to the most severe.
+const (
+	SeverityUnknown  Severity = "unknown"
+	SeverityInfo     Severity = "info"
+	SeverityLow      Severity = "low"
+	SeverityMedium   Severity = "medium"
+	SeverityHigh     Severity = "high"
+	SeverityCritical Severity = "critical"
+)
+
+// Severity is read case insensitively and stored in lower case.
+type Severity string
+
+func (s *Severity) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	*s = Severity(strings.ToLower(strings.TrimSpace(value)))
+	return nil
+}
+
+func (s Severity) valid() bool {
+	switch s {
+	case SeverityUnknown, SeverityInfo, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical:
+		return true
+	}
+	return false
+}
+
+// StringSlice accepts a list of strings or a single comma separated string,
+// as "tags: cve,cve2019,webmin,rce".
+type StringSlice []string
+
+func (s *StringSlice) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var value string
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		*s = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*s = append(*s, item)
+			}
+		}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// StringOrSlice accepts a list of strings or a single string. Unlike
+// StringSlice a single string is not split, so a reference URL may contain
+// commas.
+type StringOrSlice []string
+
+func (s *StringOrSlice) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var value string
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		*s = nil
+		if value = strings.TrimSpace(value); value != "" {
+			*s = StringOrSlice{value}
+		}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// position remembers where a mapping and each of its keys are in the file,
+// for validation errors.
+type position struct {
+	line int
+	keys map[string]int
+}
+
+func newPosition(node *yaml.Node) position {
+	p := position{line: node.Line, keys: make(map[string]int)}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			p.keys[node.Content[i].Value] = node.Content[i].Line
+		}
+	}
+	return p
+}
+
+// at returns the line of key, or of the mapping when key is not set.
+func (p position) at(key string) int {
+	if line, ok := p.keys[key]; ok {
+		return line
+	}
+	return p.line
+}
+
+func (t *Template) UnmarshalYAML(node *yaml.Node) error {
+	type plain Template
+	t.pos = newPosition(node)
+	return node.Decode((*plain)(t))
+}
+
+func (i *Info) UnmarshalYAML(node *yaml.Node) error {
+	type plain Info
+	i.pos = newPosition(node)
+	return node.Decode((*plain)(i))
+}
+
+func (c *Classification) UnmarshalYAML(node *yaml.Node) error {
+	type plain Classification
+	c.pos = newPosition(node)
+	return node.Decode((*plain)(c))
+}
+
+func (r *Request) UnmarshalYAML(node *yaml.Node) error {
+	type plain Request
+	r.pos = newPosition(node)
+	return node.Decode((*plain)(r))
+}
+
+func (m *Matcher) UnmarshalYAML(node *yaml.Node) error {
+	type plain Matcher
+	m.pos = newPosition(node)
+	return node.Decode((*plain)(m))
+}
+
+var (
+	idPattern  = regexp.MustCompile(`^([a-zA-Z0-9]+[-_.])*[a-zA-Z0-9]+$`)
+	cvePattern = regexp.MustCompile(`^(?i)CVE-\d{4}-\d{4,}$`)
+	cwePattern = regexp.MustCompile(`^(?i)CWE-\d+$`)
+)
+
+// validate checks the required fields and the values the engine relies on,
+// returning every problem found.
+func (t *Template) validate() Errors {
+	var errs Errors
+	add := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &Error{File: t.Path, Line: line, Err: fmt.Errorf(format, args...)})
+	}
+
+	switch {
+	case t.ID == "":
+		add(t.pos.at("id"), "id is required")
+	case !idPattern.MatchString(t.ID):
+		add(t.pos.at("id"), "invalid id %q", t.ID)
+	}
+
+	info := &t.Info
+	if _, ok := t.pos.keys["info"]; !ok {
+		add(t.pos.line, "info is required")
+	} else {
+		if strings.TrimSpace(info.Name) == "" {
+			add(info.pos.at("name"), "info.name is required")
+		}
+		if len(info.Author) == 0 {
+			add(info.pos.at("author"), "info.author is required")
+		}
+		switch {
+		case info.Severity == "":
+			add(info.pos.at("severity"), "info.severity is required")
+		case !info.Severity.valid():
+			add(info.pos.at("severity"), "invalid info.severity %q", info.Severity)
+		}
+	}
+	if c := info.Classification; c != nil {
+		if c.CVSSScore < 0 || c.CVSSScore > 10 {
+			add(c.pos.at("cvss-score"), "cvss-score %v is not between 0 and 10", c.CVSSScore)
+		}
+		if c.CVSSMetrics != "" && !strings.HasPrefix(c.CVSSMetrics, "CVSS:") {
+			add(c.pos.at("cvss-metrics"), "invalid cvss-metrics %q", c.CVSSMetrics)
+		}
+		for _, id := range c.CVEID {
+			if !cvePattern.MatchString(id) {
+				add(c.pos.at("cve-id"), "invalid cve-id %q", id)
+			}
+		}
+		for _, id := range c.CWEID {
+			if !cwePattern.MatchString(id) {
+				add(c.pos.at("cwe-id"), "invalid cwe-id %q", id)
+			}
+		}
+	}
+
+	if len(t.Requests) == 0 {
+		add(t.pos.at("requests"), "requests is required")
+	}
+	for i, r := range t.Requests {
+		if r == nil {
+			add(t.pos.at("requests"), "requests[%d] is empty", i)
+			continue
+		}
+		for _, err := range r.validate() {
+			add(err.line, "requests[%d]: %v", i, err.err)
+		}
+	}
+	return errs
+}
+
+// lineError is a validation error of a part of the template, before the
+// file is known.
+type lineError struct {
+	line int
+	err  error
+}
+
+func lineErrorf(line int, format string, args ...interface{}) lineError {
+	return lineError{line: line, err: fmt.Errorf(format, args...)}
+}
+
+func (r *Request) validate() []lineError {
+	var errs []lineError
+	if len(r.Path) == 0 && len(r.Raw) == 0 {
+		errs = append(errs, lineErrorf(r.pos.line, "path or raw is required"))
+	}
+	if len(r.Path) > 0 && len(r.Raw) > 0 {
+		errs = append(errs, lineErrorf(r.pos.at("raw"), "path and raw cannot both be set"))
+	}
+	if r.Method != "" && !validMethod(r.Method) {
+		errs = append(errs, lineErrorf(r.pos.at("method"), "invalid method %q", r.Method))
+	}
+	for i, raw := range r.Raw {
+		if err := checkRaw(raw); err != nil {
+			errs = append(errs, lineErrorf(r.pos.at("raw"), "raw[%d]: %v", i, err))
+		}
+	}
+	if !validCondition(r.MatchersCondition) {
+		errs = append(errs, lineErrorf(r.pos.at("matchers-condition"), "invalid matchers-condition %q", r.MatchersCondition))
+	}
+	if _, ok := r.pos.keys["matchers"]; ok && len(r.Matchers) == 0 {
+		errs = append(errs, lineErrorf(r.pos.at("matchers"), "matchers is empty"))
+	}
+	for i, m := range r.Matchers {
+		if m == nil {
+			errs = append(errs, lineErrorf(r.pos.at("matchers"), "matchers[%d] is empty", i))
+			continue
+		}
+		for _, err := range m.validate() {
+			errs = append(errs, lineErrorf(err.line, "matchers[%d]: %v", i, err.err))
+		}
+	}
+	return errs
+}
+
+func validMethod(method string) bool {
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func validCondition(condition string) bool {
+	return condition == "" || condition == "and" || condition == "or"
+}
+
+// checkRaw checks the request line of a raw request, "METHOD target HTTP/1.1".
+func checkRaw(raw string) error {
+	raw = strings.TrimLeft(raw, "\r\n")
+	line := raw
+	if i := strings.IndexAny(raw, "\r\n"); i >= 0 {
+		line = raw[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !validMethod(fields[0]) || !strings.HasPrefix(fields[2], "HTTP/") {
+		return fmt.Errorf("invalid request line %q", line)
+	}
+	return nil
+}
+
+func (m *Matcher) validate() []lineError {
+	var errs []lineError
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, lineErrorf(m.pos.at(key), format, args...))
+	}
+	if !validCondition(m.Condition) {
+		add("condition", "invalid condition %q", m.Condition)
+	}
+
+	var empty bool
+	switch m.Type {
+	case "":
+		add("type", "type is required")
+		return errs
+	case "word":
+		empty = len(m.Words) == 0
+	case "regex":
+		empty = len(m.Regex) == 0
+		for _, re := range m.Regex {
+			if _, err := regexp.Compile(re); err != nil {
+				add("regex", "%v", err)
+			}
+		}
+	case "status":
+		empty = len(m.Status) == 0
+		for _, status := range m.Status {
+			if status < 100 || status > 599 {
+				add("status", "invalid status %d", status)
+			}
+		}
+	case "size":
+		empty = len(m.Size) == 0
+	case "binary":
+		empty = len(m.Binary) == 0
+		for _, b := range m.Binary {
+			if !hexPattern.MatchString(b) {
+				add("binary", "invalid hex %q", b)
+			}
+		}
+	case "dsl":
+		empty = len(m.DSL) == 0
+	default:
+		add("type", "unknown matcher type %q", m.Type)
+		return errs
+	}
+	if empty {
+		add("type", "%s matcher has no %s", m.Type, matcherValues[m.Type])
+	}
+	return errs
+}
+
+var hexPattern = regexp.MustCompile(`^([0-9a-fA-F]{2})+$`)
 
+// matcherValues is the key holding the values of each matcher type.
+var matcherValues = map[string]string{
+	"word":   "words",
+	"regex":  "regex",
+	"status": "status",
+	"size":   "size",
+	"binary": "binary",
+	"dsl":    "dsl",
 }
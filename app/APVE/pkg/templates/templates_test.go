@@ -0,0 +1,227 @@
+package templates
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFile_Webmin(t *testing.T) {
+	path := filepath.Join("..", "..", "exploit", "script", "webmin_rce.yaml")
+	tpl, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpl.ID != "CVE-2019-15107" || tpl.Path != path {
+		t.Errorf("id %q, path %q", tpl.ID, tpl.Path)
+	}
+	info := tpl.Info
+	if info.Name != "Webmin <= 1.920 Unauthenticated Remote Command Execution" || info.Severity != SeverityCritical {
+		t.Errorf("info %+v", info)
+	}
+	if !reflect.DeepEqual(info.Author, StringSlice{"bp0lr"}) {
+		t.Errorf("author %q", info.Author)
+	}
+	if !reflect.DeepEqual(info.Tags, StringSlice{"cve", "cve2019", "webmin", "rce"}) {
+		t.Errorf("tags %q", info.Tags)
+	}
+	if len(info.Reference) != 1 || !strings.HasPrefix(info.Reference[0], "https://pentest.com.tr/") {
+		t.Errorf("reference %q", info.Reference)
+	}
+	c := info.Classification
+	if c == nil || c.CVSSScore != 9.8 || c.CVSSMetrics != "CVSS:3.0/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H" ||
+		!reflect.DeepEqual(c.CVEID, StringSlice{"CVE-2019-15107"}) || !reflect.DeepEqual(c.CWEID, StringSlice{"CWE-78"}) {
+		t.Errorf("classification %+v", c)
+	}
+
+	if len(tpl.Requests) != 1 {
+		t.Fatalf("%d requests", len(tpl.Requests))
+	}
+	r := tpl.Requests[0]
+	if len(r.Raw) != 1 || !strings.HasPrefix(r.Raw[0], "POST /password_change.cgi HTTP/1.1\nHost: {{Hostname}}\n") ||
+		!strings.HasSuffix(r.Raw[0], "\n\nuser=rootxx&pam=&old=test|cat /etc/passwd&new1=test2&new2=test2&expired=2\n") {
+		t.Errorf("raw %q", r.Raw)
+	}
+	if r.MatchersCondition != "and" || len(r.Matchers) != 1 {
+		t.Fatalf("matchers %q %d", r.MatchersCondition, len(r.Matchers))
+	}
+	if m := r.Matchers[0]; m.Type != "regex" || !reflect.DeepEqual(m.Regex, []string{"root:.*:0:0:"}) {
+		t.Errorf("matcher %+v", m)
+	}
+}
+
+func TestParse_Fields(t *testing.T) {
+	tpl, err := Parse("t.yaml", []byte(`id: apache-status
+info:
+  name: Apache server-status
+  author: [a, b]
+  severity: Info
+  reference: https://a/x,y
+requests:
+  - method: GET
+    path:
+      - "{{BaseURL}}/server-status"
+    headers:
+      X-Test: 1
+    redirects: true
+    max-redirects: 3
+    digest-username: admin
+    matchers:
+      - type: word
+        part: body
+        condition: and
+        words: [Apache, Server Status]
+      - type: status
+        status: [200]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tpl.Info.Author, StringSlice{"a", "b"}) || tpl.Info.Severity != SeverityInfo ||
+		!reflect.DeepEqual(tpl.Info.Reference, StringOrSlice{"https://a/x,y"}) || tpl.Info.Classification != nil {
+		t.Errorf("info %+v", tpl.Info)
+	}
+	r := tpl.Requests[0]
+	if r.Method != "GET" || r.Path[0] != "{{BaseURL}}/server-status" || r.Headers["X-Test"] != "1" ||
+		!r.Redirects || r.MaxRedirects != 3 || r.DigestAuthUsername != "admin" {
+		t.Errorf("request %+v", r.Request)
+	}
+	if len(r.Matchers) != 2 || r.Matchers[0].Condition != "and" || !reflect.DeepEqual(r.Matchers[1].Status, []int{200}) {
+		t.Errorf("matchers %+v", r.Matchers)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	const valid = `id: test
+info:
+  name: test
+  author: me
+  severity: low
+requests:
+  - path: ["{{BaseURL}}"]
+    matchers:
+      - type: word
+        words: [x]
+`
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{"empty", "", []string{"t.yaml: empty template"}},
+		{"not mapping", "- a\n", []string{"t.yaml:1: template is not a mapping"}},
+		{"syntax", "id: a\ninfo: [\n", []string{"t.yaml:2: did not find expected node content"}},
+		{"type", strings.Replace(valid, "low", "[low]", 1), []string{"t.yaml:5: cannot unmarshal !!seq into string"}},
+		{"missing", "id: test\n", []string{
+			"t.yaml:1: info is required",
+			"t.yaml:1: requests is required",
+		}},
+		{"info", strings.NewReplacer("name: test", "name: ''", "author: me", "foo: bar", "low", "urgent").Replace(valid), []string{
+			"t.yaml:3: info.name is required",
+			"t.yaml:3: info.author is required",
+			`t.yaml:5: invalid info.severity "urgent"`,
+		}},
+		{"id", strings.Replace(valid, "id: test", "id: 'a b'", 1), []string{`t.yaml:1: invalid id "a b"`}},
+		{"classification", strings.Replace(valid, "requests:", "  classification:\n    cvss-score: 11\n    cve-id: CVE-19\n    cwe-id: CWE-1,78\nrequests:", 1), []string{
+			"t.yaml:7: cvss-score 11 is not between 0 and 10",
+			`t.yaml:8: invalid cve-id "CVE-19"`,
+			`t.yaml:9: invalid cwe-id "78"`,
+		}},
+		{"request", strings.Replace(valid, `- path: ["{{BaseURL}}"]`, "- method: get\n    raw: ['GET /']", 1), []string{
+			`t.yaml:7: requests[0]: invalid method "get"`,
+			`t.yaml:8: requests[0]: raw[0]: invalid request line "GET /"`,
+		}},
+		{"no path", strings.Replace(valid, `- path: ["{{BaseURL}}"]`, "- matchers-condition: xor", 1), []string{
+			"t.yaml:7: requests[0]: path or raw is required",
+			`t.yaml:7: requests[0]: invalid matchers-condition "xor"`,
+		}},
+		{"matchers", strings.Replace(valid, "type: word\n        words: [x]", "type: regex\n        regex: ['(']\n      - type: word\n      - type: status\n        status: [1000]\n      - type: dsl\n      - type: foo\n      - {}", 1), []string{
+			"t.yaml:10: requests[0]: matchers[0]: error parsing regexp: missing closing ): `(`",
+			"t.yaml:11: requests[0]: matchers[1]: word matcher has no words",
+			"t.yaml:13: requests[0]: matchers[2]: invalid status 1000",
+			"t.yaml:14: requests[0]: matchers[3]: dsl matcher has no dsl",
+			`t.yaml:15: requests[0]: matchers[4]: unknown matcher type "foo"`,
+			"t.yaml:16: requests[0]: matchers[5]: type is required",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("t.yaml", []byte(tt.yaml))
+			var errs Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("error %v", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+
+	if _, err := Parse("t.yaml", []byte("\xef\xbb\xbf"+valid)); err != nil {
+		t.Errorf("BOM: %v", err)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := func(id string) string {
+		return "id: " + id + "\ninfo:\n  name: n\n  author: a\n  severity: high\nrequests:\n  - path: ['{{BaseURL}}']\n"
+	}
+	files := map[string]string{
+		"a.yaml":           template("a"),
+		"cves/b.yml":       template("b"),
+		"cves/2019/c.YAML": template("c"),
+		"cves/dup.yaml":    "\n" + template("a"),
+		"bad.yaml":         "id: bad\n",
+		"notes.txt":        "id: x",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	templates, err := LoadDir(dir)
+	var ids []string
+	for _, tpl := range templates {
+		ids = append(ids, tpl.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "c", "b"}) {
+		t.Errorf("ids %q", ids)
+	}
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("error %v", err)
+	}
+	if errs[0].File != filepath.Join(dir, "bad.yaml") || errs[0].Line != 1 {
+		t.Errorf("bad: %v", errs[0])
+	}
+	want := filepath.Join(dir, "cves/dup.yaml") + `:2: duplicate id "a", first defined in ` + filepath.Join(dir, "a.yaml") + ":1"
+	if errs[2].Error() != want {
+		t.Errorf("duplicate: %v", errs[2])
+	}
+
+	if templates, err := LoadDir(filepath.Join(dir, "a.yaml")); err != nil || len(templates) != 1 {
+		t.Errorf("file: %v, %v", templates, err)
+	}
+	if _, err := LoadDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing dir: no error")
+	}
+}